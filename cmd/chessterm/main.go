@@ -28,6 +28,10 @@ func main() {
 	log.Println("New Client")
 	cl := pkg.NewClient()
 	cl.Connect(ServerPort)
+	// Identity of the ssh key, handed over by the server when it spawns us
+	if identity := os.Getenv(pkg.EnvIdentity); identity != "" {
+		cl.Identify(identity, os.Getenv(pkg.EnvIdentityToken))
+	}
 	go cl.HandleRead()
 	go cl.HandleWrite()
 	if err := cl.App.SetRoot(cl.MenuLayout, true).EnableMouse(true).Run(); err != nil {
@@ -17,43 +17,55 @@ var (
 
 func main() {
 	logPath := flag.String("log", "~/log", "path to log file")
-	binaryPath := flag.String("binary", "../chessterm/chessterm", "path to chessterm binary")
+	binaryPath := flag.String("binary", "../chessterm/chessterm", "path to chessterm binary, see -spawn")
 	sshPort := flag.String("ssh", ":2222", "port to ssh")
+	dataPath := flag.String("data", "./data", "path to store games")
+	grace := flag.Duration("grace", pkg.ReconnectGrace, "how long the seat of a disconnected player is kept")
+	engine := flag.String("engine", pkg.EngineBinary, "path to the UCI engine of practice mode")
+	engines := flag.Int("engines", pkg.EnginePoolSize, "number of engine processes shared by practice games")
+	spawn := flag.Bool("spawn", pkg.SpawnChessterm, "run the chessterm binary for each ssh session instead of the built-in TUI")
 	flag.Parse()
+	pkg.SpawnChessterm = *spawn
+	pkg.ReconnectGrace = *grace
+	pkg.EngineBinary = *engine
+	pkg.EnginePoolSize = *engines
 	pkg.InitLog(*logPath, "SERVER: ")
 	log.Println("Server started")
-	s = pkg.NewServer(*binaryPath, *sshPort, *logPath)
+	s = pkg.NewServer(*binaryPath, *sshPort, *logPath, *dataPath)
 
 	go s.CleanIdleMatches()
 
 	// Create server to listen for data
 	listener, err := net.Listen("tcp", pkg.ServerPort)
-	log.Printf("Listening at port %s", pkg.ServerPort)
-	defer listener.Close()
 	if err != nil {
 		log.Panic(err)
 	}
-	for {
-		conn, err := listener.Accept()
-		sconn := pkg.ServerConn{Conn: conn}
-		if err != nil {
-			log.Println("Failed to connect %v", err)
-			continue
-		}
-		go s.HandleConn(sconn)
-	}
+	log.Printf("Listening at port %s", pkg.ServerPort)
 
-	// Keep the server run
+	// Wait for teminate signal, then stop taking connections
 	sigc := make(chan os.Signal, 1)
-	// Wait for teminate signal
 	signal.Notify(sigc,
 		syscall.SIGINT,
 		syscall.SIGTERM)
 	go func() {
 		<-sigc
-
-		done <- true
+		log.Println("Shutting down")
+		close(done)
+		listener.Close()
 	}()
 
-	<-done
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-done:
+				s.Shutdown()
+				return
+			default:
+			}
+			log.Printf("Failed to connect %v", err)
+			continue
+		}
+		go s.HandleConn(pkg.NewServerConn(conn))
+	}
 }
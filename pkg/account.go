@@ -0,0 +1,330 @@
+package pkg
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AccountsFile = "accounts.json"
+	// Env used to hand the ssh identity to the chessterm process
+	EnvIdentity      = "GOCHESS_IDENTITY"
+	EnvIdentityToken = "GOCHESS_IDENTITY_TOKEN"
+	MaxPrefDuration  = 180 // minutes
+	MaxPrefIncrement = 180 // seconds
+)
+
+var (
+	ErrNameTaken       = errors.New("name is already taken")
+	ErrInvalidName     = errors.New("name must be 1-20 letters, digits, _ or -")
+	ErrUnknownAccount  = errors.New("unknown account")
+	ErrUnknownPref     = errors.New("unknown preference")
+	ErrInvalidPrefVal  = errors.New("invalid preference value")
+	identitySecret     = newIdentitySecret()
+	PreferenceDefaults = map[string]string{
+		"duration":  "10",  // minutes, used by create when no duration is given
+		"increment": "0",   // seconds
+		"autoqueen": "off", // on: pawns become queens without asking
+	}
+)
+
+// An account is identified by the fingerprint of the ssh public key the player logged in with
+type Account struct {
+	Fingerprint string
+	Name        string
+	Preferences map[string]string
+	Games       []string // archived game ids
+	Ratings     map[Speed]Rating
+	CreatedAt   time.Time
+	LastSeen    time.Time
+}
+
+func (a *Account) Preference(key string) string {
+	if v, ok := a.Preferences[key]; ok {
+		return v
+	}
+	return PreferenceDefaults[key]
+}
+
+func (a *Account) copy() *Account {
+	cp := *a
+	cp.Preferences = make(map[string]string)
+	for k, v := range a.Preferences {
+		cp.Preferences[k] = v
+	}
+	cp.Games = append([]string(nil), a.Games...)
+	cp.Ratings = make(map[Speed]Rating)
+	for k, v := range a.Ratings {
+		cp.Ratings[k] = v
+	}
+	return &cp
+}
+
+func (a *Account) Rating(speed Speed) Rating {
+	if r, ok := a.Ratings[speed]; ok {
+		return r
+	}
+	return NewRating()
+}
+
+type Accounts struct {
+	Path     string
+	mu       sync.Mutex
+	accounts map[string]*Account // by fingerprint
+}
+
+func NewAccounts(path string) (*Accounts, error) {
+	accs := &Accounts{
+		Path:     path,
+		accounts: make(map[string]*Account),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return accs, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var list []*Account
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	for _, acc := range list {
+		accs.accounts[acc.Fingerprint] = acc
+	}
+	return accs, nil
+}
+
+// Caller must hold the lock
+func (accs *Accounts) save() error {
+	list := make([]*Account, 0, len(accs.accounts))
+	for _, acc := range accs.accounts {
+		list = append(list, acc)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write then rename so a crash never leaves a half written file
+	tmp := accs.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, accs.Path)
+}
+
+// Caller must hold the lock
+func (accs *Accounts) ownerOf(name string) *Account {
+	name = strings.ToLower(name)
+	for _, acc := range accs.accounts {
+		if strings.ToLower(acc.Name) == name {
+			return acc
+		}
+	}
+	return nil
+}
+
+// Get returns a copy of the account, nil if there is none
+func (accs *Accounts) Get(fingerprint string) *Account {
+	accs.mu.Lock()
+	defer accs.mu.Unlock()
+	if acc, ok := accs.accounts[fingerprint]; ok {
+		return acc.copy()
+	}
+	return nil
+}
+
+// FindByName returns a copy of the account called name, nil if there is none
+func (accs *Accounts) FindByName(name string) *Account {
+	accs.mu.Lock()
+	defer accs.mu.Unlock()
+	if acc := accs.ownerOf(name); acc != nil {
+		return acc.copy()
+	}
+	return nil
+}
+
+// Login returns the account of the fingerprint, registering it with name if it's new
+func (accs *Accounts) Login(fingerprint, name string) (*Account, error) {
+	accs.mu.Lock()
+	defer accs.mu.Unlock()
+
+	acc, ok := accs.accounts[fingerprint]
+	if !ok {
+		if accs.ownerOf(name) != nil {
+			return nil, ErrNameTaken
+		}
+		acc = &Account{
+			Fingerprint: fingerprint,
+			Name:        name,
+			Preferences: make(map[string]string),
+			CreatedAt:   time.Now(),
+		}
+		accs.accounts[fingerprint] = acc
+		log.Printf("Registered account: %s", name)
+	}
+	acc.LastSeen = time.Now()
+	return acc.copy(), accs.save()
+}
+
+// IsNameReserved reports if the name belongs to an account other than fingerprint
+func (accs *Accounts) IsNameReserved(name, fingerprint string) bool {
+	accs.mu.Lock()
+	defer accs.mu.Unlock()
+	owner := accs.ownerOf(name)
+	return owner != nil && owner.Fingerprint != fingerprint
+}
+
+func (accs *Accounts) Rename(fingerprint, name string) error {
+	if !IsValidName(name) {
+		return ErrInvalidName
+	}
+	accs.mu.Lock()
+	defer accs.mu.Unlock()
+
+	acc, ok := accs.accounts[fingerprint]
+	if !ok {
+		return ErrUnknownAccount
+	}
+	if owner := accs.ownerOf(name); owner != nil && owner != acc {
+		return ErrNameTaken
+	}
+	acc.Name = name
+	return accs.save()
+}
+
+func validPreference(key, value string) bool {
+	switch key {
+	case "autoqueen":
+		return value == "on" || value == "off"
+	case "duration":
+		n, err := strconv.Atoi(value)
+		return err == nil && n > 0 && n <= MaxPrefDuration
+	case "increment":
+		n, err := strconv.Atoi(value)
+		return err == nil && n >= 0 && n <= MaxPrefIncrement
+	}
+	return false
+}
+
+func (accs *Accounts) SetPreference(fingerprint, key, value string) error {
+	if _, ok := PreferenceDefaults[key]; !ok {
+		return ErrUnknownPref
+	}
+	if !validPreference(key, value) {
+		return ErrInvalidPrefVal
+	}
+	accs.mu.Lock()
+	defer accs.mu.Unlock()
+
+	acc, ok := accs.accounts[fingerprint]
+	if !ok {
+		return ErrUnknownAccount
+	}
+	acc.Preferences[key] = value
+	return accs.save()
+}
+
+func (accs *Accounts) AddGame(fingerprint, gameId string) error {
+	accs.mu.Lock()
+	defer accs.mu.Unlock()
+
+	acc, ok := accs.accounts[fingerprint]
+	if !ok {
+		return ErrUnknownAccount
+	}
+	acc.Games = append(acc.Games, gameId)
+	return accs.save()
+}
+
+// RecordResult updates the ratings of both players after a rated game.
+// whiteScore is 1 if white won, 0.5 for a draw and 0 if black won
+func (accs *Accounts) RecordResult(white, black string, speed Speed, whiteScore float64) (whiteRating, blackRating Rating, err error) {
+	accs.mu.Lock()
+	defer accs.mu.Unlock()
+
+	w, ok := accs.accounts[white]
+	if !ok {
+		return whiteRating, blackRating, ErrUnknownAccount
+	}
+	b, ok := accs.accounts[black]
+	if !ok {
+		return whiteRating, blackRating, ErrUnknownAccount
+	}
+	if w.Ratings == nil {
+		w.Ratings = make(map[Speed]Rating)
+	}
+	if b.Ratings == nil {
+		b.Ratings = make(map[Speed]Rating)
+	}
+	whiteRating = w.Rating(speed).Update(b.Rating(speed), whiteScore)
+	blackRating = b.Rating(speed).Update(w.Rating(speed), 1-whiteScore)
+	w.Ratings[speed] = whiteRating
+	b.Ratings[speed] = blackRating
+	return whiteRating, blackRating, accs.save()
+}
+
+// Leaderboard returns copies of the best rated accounts for speed
+func (accs *Accounts) Leaderboard(speed Speed, limit int) []*Account {
+	accs.mu.Lock()
+	defer accs.mu.Unlock()
+
+	var list []*Account
+	for _, acc := range accs.accounts {
+		if r, ok := acc.Ratings[speed]; ok && r.Games >= LeaderboardMinimum {
+			list = append(list, acc.copy())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Rating(speed).Rating > list[j].Rating(speed).Rating
+	})
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list
+}
+
+func IsValidName(name string) bool {
+	if len(name) == 0 || len(name) > 20 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func newIdentitySecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+// IdentityToken proves that an identity was handed out by this server process,
+// so nobody can claim a fingerprint by talking to the tcp port directly
+func IdentityToken(fingerprint string) string {
+	mac := hmac.New(sha256.New, identitySecret)
+	fmt.Fprint(mac, fingerprint)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func VerifyIdentity(fingerprint, token string) bool {
+	return fingerprint != "" && hmac.Equal([]byte(IdentityToken(fingerprint)), []byte(token))
+}
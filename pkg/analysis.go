@@ -0,0 +1,266 @@
+package pkg
+
+import (
+	"fmt"
+	"github.com/notnil/chess"
+	"github.com/notnil/chess/uci"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	AnalysisMoveTime = 300 * time.Millisecond // search of each position
+	AnalysisMaxScore = 1000                   // centipawns, a bigger advantage doesn't matter anymore
+	// Drops of the winning chances of the mover, in percent, as lichess judges moves
+	InaccuracyDrop = 10
+	MistakeDrop    = 20
+	BlunderDrop    = 30
+)
+
+type Judgement int
+
+const (
+	JudgementNone Judgement = iota
+	JudgementInaccuracy
+	JudgementMistake
+	JudgementBlunder
+)
+
+func (j Judgement) String() string {
+	switch j {
+	case JudgementInaccuracy:
+		return "Inaccuracy"
+	case JudgementMistake:
+		return "Mistake"
+	case JudgementBlunder:
+		return "Blunder"
+	default:
+		return ""
+	}
+}
+
+// Symbol is the annotation of the move in PGN
+func (j Judgement) Symbol() string {
+	switch j {
+	case JudgementInaccuracy:
+		return "?!"
+	case JudgementMistake:
+		return "?"
+	case JudgementBlunder:
+		return "??"
+	default:
+		return ""
+	}
+}
+
+// Evaluation of a position from White's side
+type Eval struct {
+	Score int // centipawns
+	Mate  int // moves to mate, negative when Black mates. Score doesn't count when it's set
+}
+
+// evalOf turns the score of a search, from the side to move, to White's side
+func evalOf(score uci.Score, turn chess.Color) Eval {
+	eval := Eval{Score: score.CP, Mate: score.Mate}
+	if turn == chess.Black {
+		eval.Score, eval.Mate = -eval.Score, -eval.Mate
+	}
+	return eval
+}
+
+// cp is the score with mates and big advantages capped
+func (e Eval) cp() int {
+	switch {
+	case e.Mate > 0, e.Score > AnalysisMaxScore:
+		return AnalysisMaxScore
+	case e.Mate < 0, e.Score < -AnalysisMaxScore:
+		return -AnalysisMaxScore
+	default:
+		return e.Score
+	}
+}
+
+// String is the value of a [%eval] comment: pawns or #mate
+func (e Eval) String() string {
+	if e.Mate != 0 {
+		return fmt.Sprintf("#%d", e.Mate)
+	}
+	return fmt.Sprintf("%.2f", float64(e.Score)/100)
+}
+
+// winChance of White in percent
+func (e Eval) winChance() float64 {
+	return 50 + 50*(2/(1+math.Exp(-0.00368208*float64(e.cp())))-1)
+}
+
+type AnalyzedMove struct {
+	Move      string // UCI notation
+	SAN       string
+	Eval      Eval   // after the move
+	Mated     bool   // the move is checkmate, there's nothing left to evaluate
+	Best      string // move of the engine in SAN, empty when it's the one played
+	Loss      int    // centipawns lost by the move
+	Accuracy  float64
+	Judgement Judgement
+}
+
+type Analysis struct {
+	Moves         []AnalyzedMove
+	WhiteAccuracy float64 // percent
+	BlackAccuracy float64
+	WhiteLoss     int // average centipawn loss
+	BlackLoss     int
+}
+
+// Analyze searches every position of the game and judges each move by the winning chances it threw away
+func Analyze(engines *EnginePool, moves []string) (*Analysis, error) {
+	game, err := GameFromMoves(moves)
+	if err != nil {
+		return nil, err
+	}
+	positions := game.Positions()
+	evals := make([]Eval, len(positions))
+	bests := make([]*chess.Move, len(positions))
+	mated := false
+	for i, position := range positions {
+		if len(position.ValidMoves()) == 0 { // Nothing to search, the game is over
+			if position.Status() == chess.Checkmate {
+				mated = true
+				evals[i] = Eval{Score: AnalysisMaxScore}
+				if position.Turn() == chess.White {
+					evals[i].Score = -AnalysisMaxScore
+				}
+			}
+			continue
+		}
+		results, err := engines.Search(position, SearchLimits{MoveTime: AnalysisMoveTime})
+		if err != nil {
+			return nil, err
+		}
+		evals[i] = evalOf(results.Info.Score, position.Turn())
+		bests[i] = results.BestMove
+	}
+
+	analysis := &Analysis{}
+	var accuracies, losses [2]float64
+	var counts [2]int
+	for i, move := range game.Moves() {
+		side := 0
+		sign := 1
+		if positions[i].Turn() == chess.Black {
+			side, sign = 1, -1
+		}
+		before, after := evals[i], evals[i+1]
+		analyzed := AnalyzedMove{
+			Move:  move.String(),
+			SAN:   chess.AlgebraicNotation{}.Encode(positions[i], move),
+			Eval:  after,
+			Mated: mated && i == len(game.Moves())-1,
+		}
+		drop := 0.
+		if bests[i] != nil && !sameMove(bests[i], move) {
+			analyzed.Best = chess.AlgebraicNotation{}.Encode(positions[i], bests[i])
+			if loss := sign * (before.cp() - after.cp()); loss > 0 {
+				analyzed.Loss = loss
+				if loss > AnalysisMaxScore { // lost is lost, however it happened
+					analyzed.Loss = AnalysisMaxScore
+				}
+			}
+			drop = float64(sign) * (before.winChance() - after.winChance())
+		}
+		switch {
+		case drop >= BlunderDrop:
+			analyzed.Judgement = JudgementBlunder
+		case drop >= MistakeDrop:
+			analyzed.Judgement = JudgementMistake
+		case drop >= InaccuracyDrop:
+			analyzed.Judgement = JudgementInaccuracy
+		}
+		analyzed.Accuracy = math.Max(0, math.Min(100, 103.1668*math.Exp(-0.04354*math.Max(0, drop))-3.1669))
+
+		accuracies[side] += analyzed.Accuracy
+		losses[side] += float64(analyzed.Loss)
+		counts[side]++
+		analysis.Moves = append(analysis.Moves, analyzed)
+	}
+	if counts[0] > 0 {
+		analysis.WhiteAccuracy = accuracies[0] / float64(counts[0])
+		analysis.WhiteLoss = int(losses[0] / float64(counts[0]))
+	}
+	if counts[1] > 0 {
+		analysis.BlackAccuracy = accuracies[1] / float64(counts[1])
+		analysis.BlackLoss = int(losses[1] / float64(counts[1]))
+	}
+	return analysis, nil
+}
+
+// Count is the number of moves of a side with the judgement, side 0 is White
+func (a *Analysis) Count(side int, judgement Judgement) int {
+	n := 0
+	for i := side; i < len(a.Moves); i += 2 {
+		if a.Moves[i].Judgement == judgement {
+			n++
+		}
+	}
+	return n
+}
+
+// Report sums up the analysis and lists the moves that went wrong with what the engine preferred
+func (a *Analysis) Report(white, black string) string {
+	var b strings.Builder
+	b.WriteString("[yellow]Analysis[white]\n")
+	for side, name := range []string{white, black} {
+		accuracy, loss := a.WhiteAccuracy, a.WhiteLoss
+		if side == 1 {
+			accuracy, loss = a.BlackAccuracy, a.BlackLoss
+		}
+		fmt.Fprintf(&b, "[green]%s[white]: %.0f%% accuracy, %d average centipawn loss, %d inaccuracies, %d mistakes, %d blunders\n",
+			name, accuracy, loss, a.Count(side, JudgementInaccuracy), a.Count(side, JudgementMistake), a.Count(side, JudgementBlunder))
+	}
+	for i, m := range a.Moves {
+		if m.Judgement == JudgementNone {
+			continue
+		}
+		number := fmt.Sprintf("%d.", i/2+1)
+		if i%2 == 1 {
+			number = fmt.Sprintf("%d...", i/2+1)
+		}
+		color := "yellow"
+		if m.Judgement == JudgementBlunder {
+			color = "red"
+		}
+		fmt.Fprintf(&b, "%s %s%s [%s]%s[white] (%s), [green]%s[white] was best\n", number, m.SAN, m.Judgement.Symbol(), color, m.Judgement, m.Eval, m.Best)
+	}
+	return b.String()
+}
+
+// AnalyzeRecord analyzes an archived game in the background and keeps the analysis in the archive.
+// done gets the record back, nil when the analysis failed
+func (s *Server) AnalyzeRecord(id string, done func(*GameRecord, error)) {
+	if _, busy := s.analyzing.LoadOrStore(id, true); busy {
+		done(nil, fmt.Errorf("game %s is already being analyzed", id))
+		return
+	}
+	go func() {
+		defer s.analyzing.Delete(id)
+		record, err := s.Archive.Load(id)
+		if err != nil {
+			done(nil, err)
+			return
+		}
+		if record.Analysis == nil {
+			start := time.Now()
+			if record.Analysis, err = Analyze(s.Engines, record.Moves); err != nil {
+				done(nil, err)
+				return
+			}
+			log.Printf("Analyzed game %s in %s", id, time.Since(start).Round(time.Second))
+			if err := s.Archive.Save(record); err != nil {
+				log.Printf("Failed to save the analysis of %s: %v", id, err)
+			}
+		}
+		done(record, nil)
+	}()
+}
@@ -0,0 +1,236 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/notnil/chess"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ArchiveDir       = "games"
+	ArchiveListLimit = 20
+)
+
+var unsafeIdChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// A finished game, stored on disk so players can review it later
+type GameRecord struct {
+	Id          string
+	Match       string
+	White       string
+	Black       string
+	Duration    time.Duration
+	Increment   time.Duration
+	Control     string // compact time control, see ParseTimeControl
+	Result      chess.Outcome
+	Termination string
+	Moves       []string        // UCI notation
+	Clocks      []time.Duration // remaining time of the mover after each move
+	WhiteClock  time.Duration
+	BlackClock  time.Duration
+	WhiteHints  int // hints taken in practice mode
+	BlackHints  int
+	StartedAt   time.Time
+	EndedAt     time.Time
+	Analysis    *Analysis `json:",omitempty"` // engine review, once someone asked for it
+}
+
+type Archive struct {
+	Dir string
+	mu  sync.Mutex
+}
+
+func NewArchive(dir string) (*Archive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Archive{Dir: dir}, nil
+}
+
+func (a *Archive) recordPath(id string) string {
+	return path.Join(a.Dir, id+".json")
+}
+
+func (a *Archive) Save(r *GameRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if r.Id == "" {
+		slug := unsafeIdChars.ReplaceAllString(strings.ToLower(r.Match), "-")
+		r.Id = fmt.Sprintf("%s-%s", r.EndedAt.Format("20060102-150405"), strings.Trim(slug, "-"))
+		for i := 2; ; i++ { // two games of the same match can end within a second
+			if _, err := os.Stat(a.recordPath(r.Id)); os.IsNotExist(err) {
+				break
+			}
+			r.Id = fmt.Sprintf("%s-%s-%d", r.EndedAt.Format("20060102-150405"), strings.Trim(slug, "-"), i)
+		}
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(a.recordPath(r.Id), data, 0644)
+}
+
+func (a *Archive) Load(id string) (*GameRecord, error) {
+	id = strings.ToLower(strings.TrimSpace(id))
+	if id == "" || unsafeIdChars.MatchString(id) {
+		return nil, fmt.Errorf("invalid game id: %q", id)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	data, err := ioutil.ReadFile(a.recordPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var r GameRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// List returns the archived games, newest first
+func (a *Archive) List() ([]*GameRecord, error) {
+	a.mu.Lock()
+	files, err := ioutil.ReadDir(a.Dir)
+	a.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*GameRecord
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		r, err := a.Load(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].EndedAt.After(records[j].EndedAt)
+	})
+	return records, nil
+}
+
+// Message shows the game in the client, with the report of the engine when it was analyzed
+func (r *GameRecord) Message() MessageArchivedGame {
+	pgn := r.PGN()
+	if r.Analysis != nil {
+		pgn = r.Analysis.Report(r.White, r.Black) + "\n" + pgn
+	}
+	return MessageArchivedGame{
+		Id:          r.Id,
+		White:       r.White,
+		Black:       r.Black,
+		Result:      r.Result.String(),
+		Termination: r.Termination,
+		Moves:       r.Moves,
+		WhiteClock:  r.WhiteClock,
+		BlackClock:  r.BlackClock,
+		PGN:         pgn,
+	}
+}
+
+func (r *GameRecord) Game() (*chess.Game, error) {
+	return GameFromMoves(r.Moves)
+}
+
+// PGN tag for the time control, in seconds as the PGN standard expects
+func (r *GameRecord) TimeControl() string {
+	if tc, err := ParseTimeControl(r.Control); err == nil {
+		return tc.PGN()
+	}
+	// Games archived before time controls had periods
+	return fmt.Sprintf("%d+%d", int(r.Duration.Seconds()), int(r.Increment.Seconds()))
+}
+
+// Termination tag as defined by the PGN standard
+func (r *GameRecord) PGNTermination() string {
+	switch r.Termination {
+	case "Time Out":
+		return "time forfeit"
+	case "Abandoned":
+		return "abandoned"
+	case "Engine failure":
+		return "emergency"
+	case "": // still going on
+		return "unterminated"
+	default:
+		return "normal"
+	}
+}
+
+func (r *GameRecord) PGN() string {
+	var b strings.Builder
+	tags := [][2]string{
+		{"Event", "GoChess game"},
+		{"Site", "gochess.club"},
+		{"Date", r.StartedAt.Format("2006.01.02")},
+		{"Round", "-"},
+		{"White", r.White},
+		{"Black", r.Black},
+		{"Result", r.Result.String()},
+		{"TimeControl", r.TimeControl()},
+		{"Termination", r.PGNTermination()},
+		{"Method", r.Termination},
+		{"WhiteClock", formatClock(r.WhiteClock)},
+		{"BlackClock", formatClock(r.BlackClock)},
+	}
+	if r.WhiteHints > 0 || r.BlackHints > 0 {
+		tags = append(tags, [2]string{"WhiteHints", strconv.Itoa(r.WhiteHints)}, [2]string{"BlackHints", strconv.Itoa(r.BlackHints)})
+	}
+	for _, tag := range tags {
+		fmt.Fprintf(&b, "[%s \"%s\"]\n", tag[0], strings.ReplaceAll(tag[1], `"`, `'`))
+	}
+	b.WriteString("\n")
+
+	game, _ := r.Game() // keep the moves that replay cleanly even if the record is damaged
+	positions := game.Positions()
+	for i, move := range game.Moves() {
+		if i%2 == 0 {
+			fmt.Fprintf(&b, "%d. ", i/2+1)
+		}
+		b.WriteString(chess.AlgebraicNotation{}.Encode(positions[i], move))
+		var comment []string
+		if r.Analysis != nil && i < len(r.Analysis.Moves) {
+			analyzed := r.Analysis.Moves[i]
+			b.WriteString(analyzed.Judgement.Symbol())
+			if !analyzed.Mated {
+				comment = append(comment, fmt.Sprintf("[%%eval %s]", analyzed.Eval))
+			}
+		}
+		if i < len(r.Clocks) {
+			comment = append(comment, fmt.Sprintf("[%%clk %s]", formatClock(r.Clocks[i])))
+		}
+		if r.Analysis != nil && i < len(r.Analysis.Moves) && r.Analysis.Moves[i].Judgement != JudgementNone {
+			analyzed := r.Analysis.Moves[i]
+			comment = append(comment, fmt.Sprintf("%s. %s was best.", analyzed.Judgement, analyzed.Best))
+		}
+		if len(comment) > 0 {
+			fmt.Fprintf(&b, " {%s}", strings.Join(comment, " "))
+		}
+		b.WriteString(" ")
+	}
+	b.WriteString(r.Result.String())
+	b.WriteString("\n")
+	return b.String()
+}
+
+func formatClock(d time.Duration) string {
+	return fmt.Sprintf("%d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+}
@@ -0,0 +1,549 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"github.com/notnil/chess"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ArenaPairingInterval = 3 * time.Second
+	ArenaWinPoints       = 2
+	ArenaDrawPoints      = 1
+	ArenaBerserkBonus    = 1 // extra point for winning a berserk game
+	ArenaStreak          = 2 // wins in a row after which points are doubled
+)
+
+var (
+	ErrArenaExisted   = errors.New("arena name existed")
+	ErrArenaNotFound  = errors.New("arena not found")
+	ErrArenaFinished  = errors.New("arena is over")
+	ErrArenaNotJoined = errors.New("you haven't joined")
+)
+
+type ArenaPlayer struct {
+	Key          string // ServerConn.Key
+	Name         string
+	Rating       float64
+	Score        int
+	Streak       int   // wins in a row
+	Results      []int // points of each game
+	Whites       int
+	Blacks       int
+	LastOpponent *ArenaPlayer
+	Playing      *Match // the game being played, if any
+	Waiting      bool   // in the pairing pool
+	Conn         *ServerConn
+}
+
+// OnFire is true when the player won the last games, the next points are doubled
+func (ap *ArenaPlayer) OnFire() bool {
+	return ap.Streak >= ArenaStreak
+}
+
+// An arena runs for a fixed time, players are paired again as soon as they finish a game
+type Arena struct {
+	Name      string
+	Owner     string // ServerConn.Key of the creator
+	Duration  int    // minutes
+	Increment int    // seconds
+	Length    time.Duration
+	EndsAt    time.Time
+	State     TournamentState
+	Players   []*ArenaPlayer
+	Games     int // number of games started
+	Server    *Server
+	mu        sync.Mutex
+	pending   []notice // sent once the lock is released
+}
+
+func (a *Arena) Join(sconn *ServerConn, rating float64) error {
+	a.mu.Lock()
+	defer a.unlock()
+
+	if a.State == TournamentFinished {
+		return ErrArenaFinished
+	}
+	running := a.State == TournamentRunning
+	for _, p := range a.Players {
+		if p.Key == sconn.Key() {
+			// Coming back after a pause
+			p.Conn = sconn
+			p.Waiting = running
+			a.send(p, fmt.Sprintf("You are back in arena [red]%s[white]", a.Name))
+			return nil
+		}
+	}
+	a.Players = append(a.Players, &ArenaPlayer{
+		Key:     sconn.Key(),
+		Name:    sconn.Name,
+		Rating:  rating,
+		Waiting: running,
+		Conn:    sconn,
+	})
+	a.broadcast(fmt.Sprintf("[green]%s[white] joined arena [red]%s[white] (%d players)", strings.Title(sconn.Name), a.Name, len(a.Players)))
+	return nil
+}
+
+// Leave takes the player out of the pairing pool, the points are kept
+func (a *Arena) Leave(sconn *ServerConn) error {
+	a.mu.Lock()
+	defer a.unlock()
+
+	for _, p := range a.Players {
+		if p.Key == sconn.Key() {
+			p.Waiting = false
+			return nil
+		}
+	}
+	return ErrArenaNotJoined
+}
+
+func (a *Arena) Start(sconn *ServerConn) error {
+	a.mu.Lock()
+	defer a.unlock()
+
+	if a.Owner != sconn.Key() {
+		return ErrTournamentOwner
+	}
+	if a.State != TournamentRegistering {
+		return ErrTournamentStarted
+	}
+	if len(a.Players) < 2 {
+		return ErrTournamentPlayers
+	}
+	a.State = TournamentRunning
+	a.EndsAt = time.Now().Add(a.Length)
+	for _, p := range a.Players {
+		p.Waiting = true
+	}
+	log.Printf("Arena %s started", a.Name)
+	a.broadcast(fmt.Sprintf("Arena [red]%s[white] has started, it ends in %s. You'll be paired in a moment", a.Name, a.Length))
+	go a.Run()
+	return nil
+}
+
+// Run pairs the waiting players until the arena is over
+func (a *Arena) Run() {
+	tick := time.NewTicker(ArenaPairingInterval)
+	defer tick.Stop()
+	end := time.NewTimer(a.Length)
+	for {
+		select {
+		case <-tick.C:
+			a.mu.Lock()
+			a.pair()
+			a.unlock()
+
+		case <-end.C:
+			a.mu.Lock()
+			if a.State != TournamentFinished {
+				a.broadcast(fmt.Sprintf("Time is up in arena [red]%s[white]! Games still being played will count", a.Name))
+			}
+			a.checkEnd()
+			a.unlock()
+			return
+		}
+	}
+}
+
+// Players with close scores are paired, avoiding the same opponent twice in a row. Caller must hold the lock
+func (a *Arena) pair() {
+	if !time.Now().Before(a.EndsAt) {
+		return
+	}
+	var pool []*ArenaPlayer
+	for _, p := range a.Players {
+		if !p.Waiting || p.Playing != nil {
+			continue
+		}
+		if p.Conn == nil || p.Conn.Closed() {
+			p.Waiting = false
+			continue
+		}
+		pool = append(pool, p)
+	}
+	sort.SliceStable(pool, func(i, j int) bool {
+		if pool[i].Score != pool[j].Score {
+			return pool[i].Score > pool[j].Score
+		}
+		return pool[i].Rating > pool[j].Rating
+	})
+
+	for len(pool) >= 2 {
+		first := pool[0]
+		j := 1
+		for j < len(pool) && first.LastOpponent == pool[j] {
+			j++
+		}
+		if j == len(pool) { // Nobody else is waiting
+			j = 1
+		}
+		second := pool[j]
+		pool = append(pool[1:j], pool[j+1:]...)
+		a.startGame(first, second)
+	}
+}
+
+// Caller must hold the lock
+func (a *Arena) startGame(white, black *ArenaPlayer) {
+	// The one who had white more often gets black
+	if dw, db := white.Whites-white.Blacks, black.Whites-black.Blacks; dw > db || (dw == db && rand.Intn(2) == 0) {
+		white, black = black, white
+	}
+	s := a.Server
+	a.Games++
+	m := s.createNamedMatch(fmt.Sprintf("%s-%d", a.Name, a.Games), func(name string) *Match {
+		m := NewMatch(s, name, false, a.Duration, a.Increment)
+		m.AllowBerserk = true
+		m.Seats[White] = white.Conn.SeatKey()
+		m.Seats[Black] = black.Conn.SeatKey()
+		m.OnEnd = func(m *Match, outcome chess.Outcome) {
+			go a.Report(m, white, black, outcome)
+		}
+		m.OnAbort = func(m *Match) {
+			go a.Report(m, white, black, chess.NoOutcome)
+		}
+		return m
+	})
+	m.ExpectPlayers(NoShowTimeout)
+
+	white.Whites++
+	black.Blacks++
+	for role, p := range map[PlayerRole]*ArenaPlayer{White: white, Black: black} {
+		opponent := black
+		if role == Black {
+			opponent = white
+		}
+		p.Playing = m
+		p.Waiting = false
+		p.LastOpponent = opponent
+		a.send(p, fmt.Sprintf("Arena [red]%s[white]: you play %s against [green]%s[white]. Exit your current game to start. Type [green]join %s[white] if you're not taken there", a.Name, role, strings.Title(opponent.Name), m.Name))
+		p.Conn.AssignSeat(Assignment{Match: m, Role: role})
+	}
+	log.Printf("Arena %s paired %s and %s in match %s", a.Name, white.Name, black.Name, m.Name)
+}
+
+// Report scores a finished arena game and puts both players back in the pool.
+// A game closed without a result scores nothing
+func (a *Arena) Report(m *Match, white, black *ArenaPlayer, outcome chess.Outcome) {
+	a.mu.Lock()
+	defer a.unlock()
+
+	if white.Playing != m || black.Playing != m { // Already reported
+		return
+	}
+	if outcome == chess.NoOutcome { // Nobody showed up, they're out of the pool until they join again
+		for _, p := range []*ArenaPlayer{white, black} {
+			p.Playing = nil
+			p.Waiting = false
+			a.send(p, fmt.Sprintf("Arena [red]%s[white]: the game in %s was closed without a result. Type [green]arena join %s[white] to be paired again", a.Name, m.Name, a.Name))
+		}
+		a.checkEnd()
+		return
+	}
+	var whiteResult float64
+	switch outcome {
+	case chess.WhiteWon:
+		whiteResult = 1
+	case chess.Draw:
+		whiteResult = 0.5
+	}
+	for _, r := range []struct {
+		player *ArenaPlayer
+		result float64
+		role   PlayerRole
+	}{{white, whiteResult, White}, {black, 1 - whiteResult, Black}} {
+		p := r.player
+		p.Playing = nil
+		points := a.record(p, r.result, m.Berserked[r.role])
+		text := fmt.Sprintf("Arena [red]%s[white]: +%d points, %d in total", a.Name, points, p.Score)
+		if p.OnFire() {
+			text += ". You are on fire, next points are doubled!"
+		}
+		if time.Now().Before(a.EndsAt) {
+			p.Waiting = true
+			text += ". Looking for your next opponent..."
+		}
+		a.send(p, text)
+	}
+	a.checkEnd()
+}
+
+// Caller must hold the lock
+func (a *Arena) record(p *ArenaPlayer, result float64, berserk bool) int {
+	points := 0
+	switch result {
+	case 1:
+		points = ArenaWinPoints
+	case 0.5:
+		points = ArenaDrawPoints
+	}
+	if p.OnFire() {
+		points *= 2
+	}
+	if berserk && result == 1 {
+		points += ArenaBerserkBonus
+	}
+	if result == 1 {
+		p.Streak++
+	} else {
+		p.Streak = 0
+	}
+	p.Score += points
+	p.Results = append(p.Results, points)
+	return points
+}
+
+// The arena is over once the time is up and the last game has finished. Caller must hold the lock
+func (a *Arena) checkEnd() {
+	if a.State != TournamentRunning || time.Now().Before(a.EndsAt) {
+		return
+	}
+	for _, p := range a.Players {
+		if p.Playing != nil {
+			return
+		}
+	}
+	a.State = TournamentFinished
+	log.Printf("Arena %s finished", a.Name)
+	a.broadcast(fmt.Sprintf("Arena [red]%s[white] is over!\n%s", a.Name, a.standingsString()))
+}
+
+// Caller must hold the lock
+func (a *Arena) standings() []*ArenaPlayer {
+	standings := append([]*ArenaPlayer(nil), a.Players...)
+	sort.SliceStable(standings, func(i, j int) bool {
+		if standings[i].Score != standings[j].Score {
+			return standings[i].Score > standings[j].Score
+		}
+		return standings[i].Rating > standings[j].Rating
+	})
+	return standings
+}
+
+// Caller must hold the lock
+func (a *Arena) standingsString() string {
+	text := fmt.Sprintf("%-4s %-20s %5s  %s\n", "#", "Name", "Score", "Games")
+	for i, p := range a.standings() {
+		results := make([]string, len(p.Results))
+		for j, points := range p.Results {
+			results[j] = strconv.Itoa(points)
+		}
+		status := ""
+		if p.OnFire() {
+			status += " [red]on fire[white]"
+		}
+		if p.Playing != nil {
+			status += " [gray]playing[white]"
+		}
+		text += fmt.Sprintf("%-4d [green]%-20s[white] %5d  %s%s\n", i+1, strings.Title(p.Name), p.Score, strings.Join(results, " "), status)
+	}
+	return text
+}
+
+func (a *Arena) String() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	text := fmt.Sprintf("Arena [red]%s[white]: %d+%d, %s, %s", a.Name, a.Duration, a.Increment, a.Length, a.State)
+	if a.State == TournamentRunning {
+		if left := time.Until(a.EndsAt); left > 0 {
+			text += fmt.Sprintf(", %s left", left.Round(time.Second))
+		} else {
+			text += ", waiting for the last games"
+		}
+	}
+	return text + "\n" + a.standingsString()
+}
+
+// send queues the message until the lock is released. Caller must hold the lock
+func (a *Arena) send(p *ArenaPlayer, text string) {
+	if p.Conn != nil {
+		a.pending = append(a.pending, notice{conn: p.Conn, text: text})
+	}
+}
+
+// unlock releases the lock, then sends the messages queued while holding it
+func (a *Arena) unlock() {
+	pending := a.pending
+	a.pending = nil
+	a.mu.Unlock()
+	for _, n := range pending {
+		notify(n.conn, n.text)
+	}
+}
+
+// Caller must hold the lock
+func (a *Arena) broadcast(text string) {
+	for _, p := range a.Players {
+		a.send(p, text)
+	}
+}
+
+type ArenaManager struct {
+	Server *Server
+	mu     sync.Mutex
+	arenas map[string]*Arena
+}
+
+func NewArenaManager(s *Server) *ArenaManager {
+	return &ArenaManager{
+		Server: s,
+		arenas: make(map[string]*Arena),
+	}
+}
+
+func (am *ArenaManager) Create(owner *ServerConn, name string, length time.Duration, duration, increment int) (*Arena, error) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if _, ok := am.arenas[name]; ok {
+		return nil, ErrArenaExisted
+	}
+	a := &Arena{
+		Name:      name,
+		Owner:     owner.Key(),
+		Length:    length,
+		Duration:  duration,
+		Increment: increment,
+		Server:    am.Server,
+	}
+	am.arenas[name] = a
+	return a, nil
+}
+
+func (am *ArenaManager) Get(name string) (*Arena, error) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	a, ok := am.arenas[name]
+	if !ok {
+		return nil, ErrArenaNotFound
+	}
+	return a, nil
+}
+
+func (am *ArenaManager) List() []*Arena {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	list := make([]*Arena, 0, len(am.arenas))
+	for _, a := range am.arenas {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+const arenaUsage = `Arena commands:
+> [green]arena create (name) (length) (duration) (increment)[white] : length of the arena in minutes
+> [green]arena join (name)[white]  : join, or come back after a pause
+> [green]arena leave (name)[white] : stop getting paired, your points are kept
+> [green]arena start (name)[white] : only the creator can start it
+> [green]arena view (name)[white]  : live scoreboard
+Win: 2 points, draw: 1. After 2 wins in a row points are doubled. Berserk halves your clock for an extra point if you win`
+
+func (s *Server) HandleArenaCommand(sconn *ServerConn, args []string) {
+	reply := func(text string) {
+		sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{text}})
+	}
+	if len(args) == 0 || args[0] == "" {
+		arenas := s.Arenas.List()
+		if len(arenas) == 0 {
+			reply("No arena yet :( Let's create one!\n" + arenaUsage)
+			return
+		}
+		text := "Arenas:\n"
+		for _, a := range arenas {
+			a.mu.Lock()
+			text += fmt.Sprintf("[red]%s[white] %d+%d, %s, %d players, %s\n", a.Name, a.Duration, a.Increment, a.Length, len(a.Players), a.State)
+			a.mu.Unlock()
+		}
+		reply(text)
+		return
+	}
+	if len(args) < 2 {
+		reply(arenaUsage)
+		return
+	}
+	if sconn.Name == "" {
+		sconn.Name = s.GuestName()
+	}
+	name := strings.ToLower(args[1])
+
+	switch args[0] {
+	case "create":
+		length, duration, increment := 30, 3, 0
+		if len(args) > 2 {
+			length, _ = strconv.Atoi(args[2])
+		}
+		if len(args) > 3 {
+			duration, _ = strconv.Atoi(args[3])
+		}
+		if len(args) > 4 {
+			increment, _ = strconv.Atoi(args[4])
+		}
+		if length <= 0 || duration <= 0 || increment < 0 {
+			reply(arenaUsage)
+			return
+		}
+		if _, err := s.Arenas.Create(sconn, name, time.Duration(length)*time.Minute, duration, increment); err != nil {
+			reply(fmt.Sprintf("Can't create arena [red]%s[white]: %s", name, err))
+			return
+		}
+		reply(fmt.Sprintf("Created arena [red]%s[white]. Players join with [green]arena join %s[white], then start it with [green]arena start %s[white]", name, name, name))
+
+	case "join":
+		a, err := s.Arenas.Get(name)
+		if err != nil {
+			reply(fmt.Sprintf("Can't join [red]%s[white]: %s", name, err))
+			return
+		}
+		rating := RatingDefault
+		if acc := s.Accounts.Get(sconn.Identity); acc != nil {
+			rating = acc.Rating(SpeedOf(time.Duration(a.Duration)*time.Minute, time.Duration(a.Increment)*time.Second)).Rating
+		}
+		if err := a.Join(sconn, rating); err != nil {
+			reply(fmt.Sprintf("Can't join [red]%s[white]: %s", name, err))
+		}
+
+	case "leave":
+		a, err := s.Arenas.Get(name)
+		if err == nil {
+			err = a.Leave(sconn)
+		}
+		if err != nil {
+			reply(fmt.Sprintf("Can't leave [red]%s[white]: %s", name, err))
+			return
+		}
+		reply(fmt.Sprintf("You won't be paired in [red]%s[white] anymore. Type [green]arena join %s[white] to come back", name, name))
+
+	case "start":
+		a, err := s.Arenas.Get(name)
+		if err == nil {
+			err = a.Start(sconn)
+		}
+		if err != nil {
+			reply(fmt.Sprintf("Can't start [red]%s[white]: %s", name, err))
+		}
+
+	case "view":
+		a, err := s.Arenas.Get(name)
+		if err != nil {
+			reply(fmt.Sprintf("Can't view [red]%s[white]: %s", name, err))
+			return
+		}
+		reply(a.String())
+
+	default:
+		reply(arenaUsage)
+	}
+}
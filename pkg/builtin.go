@@ -0,0 +1,404 @@
+package pkg
+
+import (
+	"github.com/notnil/chess"
+	"github.com/notnil/chess/uci"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// The built-in engine: alpha-beta with iterative deepening and quiescence search on
+// top of notnil/chess, used when no UCI engine can be started. It's no Stockfish,
+// but it plays sensible moves at every practice level
+
+const (
+	BuiltinEngineName   = "GoChess"
+	BuiltinTableSize    = 1 << 20 // entries of the transposition table before it's cleared
+	BuiltinMinMoveTime  = 500 * time.Millisecond
+	BuiltinMaxDepth     = 64
+	builtinMate         = 100000
+	builtinInfinity     = 1000000
+	builtinMateInMoves  = builtinMate - 1000 // scores above this are mates
+	builtinCheckEveryNs = 1023               // nodes between two looks at the clock
+)
+
+type builtinLevel struct {
+	Depth int // deepest iteration
+	Noise int // random centipawns added to the moves at the root, the weaker the more mistakes
+}
+
+// Strength of each practice level, 0 is full strength
+var BuiltinLevels = []builtinLevel{
+	{Depth: BuiltinMaxDepth},
+	{Depth: 1, Noise: 200},
+	{Depth: 2, Noise: 100},
+	{Depth: 3, Noise: 50},
+	{Depth: 4, Noise: 20},
+	{Depth: 5},
+}
+
+type ttFlag uint8
+
+const (
+	ttExact ttFlag = iota
+	ttLower        // the score is at least this
+	ttUpper        // the score is at most this
+)
+
+type ttEntry struct {
+	Depth int
+	Score int
+	Flag  ttFlag
+	Best  *chess.Move
+}
+
+type BuiltinEngine struct {
+	table    map[[16]byte]ttEntry
+	nodes    int
+	deadline time.Time
+	stopped  bool
+}
+
+func NewBuiltinEngine() *BuiltinEngine {
+	return &BuiltinEngine{table: make(map[[16]byte]ttEntry)}
+}
+
+func (e *BuiltinEngine) Name() string {
+	return BuiltinEngineName
+}
+
+func (e *BuiltinEngine) NewGame() error {
+	e.table = make(map[[16]byte]ttEntry)
+	return nil
+}
+
+func (e *BuiltinEngine) Close() error {
+	return nil
+}
+
+func (e *BuiltinEngine) Search(position *chess.Position, limits SearchLimits) (uci.SearchResults, error) {
+	var results uci.SearchResults
+	moves := position.ValidMoves()
+	if len(moves) == 0 {
+		return results, ErrNoMove
+	}
+	level := BuiltinLevels[0]
+	if n := limits.level(); n > 0 {
+		level = BuiltinLevels[len(BuiltinLevels)-1]
+		if n < len(BuiltinLevels) {
+			level = BuiltinLevels[n]
+		}
+	}
+	moveTime := limits.budget(position.Turn())
+	if moveTime < BuiltinMinMoveTime && !limits.timed() {
+		moveTime = BuiltinMinMoveTime
+	}
+
+	// The noise of a move stays the same at every depth
+	noise := make(map[*chess.Move]int, len(moves))
+	for _, m := range moves {
+		if level.Noise > 0 {
+			noise[m] = rand.Intn(2*level.Noise+1) - level.Noise
+		}
+	}
+
+	start := time.Now()
+	e.deadline = start.Add(moveTime)
+	e.stopped = false
+	e.nodes = 0
+	results.BestMove = moves[0]
+	for depth := 1; depth <= level.Depth; depth++ {
+		best, score := e.root(position, moves, noise, depth)
+		if e.stopped {
+			break
+		}
+		results.BestMove = best
+		results.Info = uci.Info{Depth: depth, Nodes: e.nodes, Time: time.Since(start), PV: []*chess.Move{best}, Score: builtinScore(score)}
+		if score > builtinMateInMoves || score < -builtinMateInMoves {
+			break
+		}
+		// Best move of this depth goes first in the next one
+		for i, m := range moves {
+			if m == best {
+				copy(moves[1:i+1], moves[:i])
+				moves[0] = best
+				break
+			}
+		}
+	}
+	return results, nil
+}
+
+// Score as a UCI engine reports it, from the side to move
+func builtinScore(score int) uci.Score {
+	switch {
+	case score > builtinMateInMoves:
+		return uci.Score{Mate: (builtinMate - score + 1) / 2}
+	case score < -builtinMateInMoves:
+		return uci.Score{Mate: -(builtinMate + score + 1) / 2}
+	default:
+		return uci.Score{CP: score}
+	}
+}
+
+func (e *BuiltinEngine) root(position *chess.Position, moves []*chess.Move, noise map[*chess.Move]int, depth int) (*chess.Move, int) {
+	alpha := -builtinInfinity
+	best := moves[0]
+	for _, m := range moves {
+		// The window is shifted by the noise so the noisy scores compare with each other
+		score := -e.negamax(position.Update(m), depth-1, -builtinInfinity, -(alpha-noise[m]), m.HasTag(chess.Check), 1) + noise[m]
+		if e.stopped {
+			break
+		}
+		if score > alpha {
+			alpha, best = score, m
+		}
+	}
+	return best, alpha
+}
+
+func (e *BuiltinEngine) tick() {
+	e.nodes++
+	if e.nodes&builtinCheckEveryNs == 0 && time.Now().After(e.deadline) {
+		e.stopped = true
+	}
+}
+
+func (e *BuiltinEngine) negamax(position *chess.Position, depth, alpha, beta int, inCheck bool, ply int) int {
+	e.tick()
+	if e.stopped {
+		return 0
+	}
+	if depth <= 0 {
+		// A check is never quiet, it's searched one more ply unless checks go on forever
+		if !inCheck || ply >= 2*BuiltinMaxDepth {
+			return e.quiesce(position, alpha, beta)
+		}
+		depth = 1
+	}
+
+	hash := position.Hash()
+	entry, found := e.table[hash]
+	if found && entry.Depth >= depth {
+		score := fromTable(entry.Score, ply)
+		switch {
+		case entry.Flag == ttExact,
+			entry.Flag == ttLower && score >= beta,
+			entry.Flag == ttUpper && score <= alpha:
+			return score
+		}
+	}
+
+	moves := position.ValidMoves()
+	if len(moves) == 0 {
+		if inCheck {
+			return -builtinMate + ply
+		}
+		return 0
+	}
+	orderMoves(position, moves, entry.Best)
+
+	original := alpha
+	var best *chess.Move
+	for _, m := range moves {
+		score := -e.negamax(position.Update(m), depth-1, -beta, -alpha, m.HasTag(chess.Check), ply+1)
+		if e.stopped {
+			return 0
+		}
+		if score > alpha {
+			alpha, best = score, m
+		}
+		if alpha >= beta {
+			break
+		}
+	}
+
+	flag := ttExact
+	if alpha <= original {
+		flag = ttUpper
+	} else if alpha >= beta {
+		flag = ttLower
+	}
+	if len(e.table) >= BuiltinTableSize {
+		e.table = make(map[[16]byte]ttEntry)
+	}
+	e.table[hash] = ttEntry{Depth: depth, Score: toTable(alpha, ply), Flag: flag, Best: best}
+	return alpha
+}
+
+// Mates are stored as distance from the position, not from the root
+func toTable(score, ply int) int {
+	if score > builtinMateInMoves {
+		return score + ply
+	} else if score < -builtinMateInMoves {
+		return score - ply
+	}
+	return score
+}
+
+func fromTable(score, ply int) int {
+	if score > builtinMateInMoves {
+		return score - ply
+	} else if score < -builtinMateInMoves {
+		return score + ply
+	}
+	return score
+}
+
+// quiesce only looks at captures and promotions so the evaluation isn't done in the middle of a trade
+func (e *BuiltinEngine) quiesce(position *chess.Position, alpha, beta int) int {
+	e.tick()
+	if e.stopped {
+		return 0
+	}
+	standPat := Evaluate(position)
+	if standPat >= beta {
+		return beta
+	}
+	if standPat > alpha {
+		alpha = standPat
+	}
+
+	var captures []*chess.Move
+	for _, m := range position.ValidMoves() {
+		if m.HasTag(chess.Capture) || m.Promo() != chess.NoPieceType {
+			captures = append(captures, m)
+		}
+	}
+	orderMoves(position, captures, nil)
+	for _, m := range captures {
+		score := -e.quiesce(position.Update(m), -beta, -alpha)
+		if e.stopped {
+			return 0
+		}
+		if score >= beta {
+			return beta
+		}
+		if score > alpha {
+			alpha = score
+		}
+	}
+	return alpha
+}
+
+func sameMove(a, b *chess.Move) bool {
+	return a != nil && b != nil && a.S1() == b.S1() && a.S2() == b.S2() && a.Promo() == b.Promo()
+}
+
+// orderMoves puts the best move found before first, then the captures of big pieces by small ones
+func orderMoves(position *chess.Position, moves []*chess.Move, best *chess.Move) {
+	board := position.Board()
+	score := func(m *chess.Move) int {
+		if sameMove(m, best) {
+			return 1 << 20
+		}
+		s := 0
+		if m.HasTag(chess.Capture) {
+			victim := chess.Pawn // en passant
+			if p := board.Piece(m.S2()); p != chess.NoPiece {
+				victim = p.Type()
+			}
+			s += 10*pieceValues[victim] - pieceValues[board.Piece(m.S1()).Type()]
+		}
+		if m.Promo() != chess.NoPieceType {
+			s += pieceValues[m.Promo()]
+		}
+		return s
+	}
+	sort.SliceStable(moves, func(i, j int) bool { return score(moves[i]) > score(moves[j]) })
+}
+
+var pieceValues = map[chess.PieceType]int{
+	chess.Pawn:   100,
+	chess.Knight: 320,
+	chess.Bishop: 330,
+	chess.Rook:   500,
+	chess.Queen:  900,
+	chess.King:   0,
+}
+
+// Piece square tables from White's side, a8 first. Black reads them upside down
+var pieceSquares = map[chess.PieceType][64]int{
+	chess.Pawn: {
+		0, 0, 0, 0, 0, 0, 0, 0,
+		50, 50, 50, 50, 50, 50, 50, 50,
+		10, 10, 20, 30, 30, 20, 10, 10,
+		5, 5, 10, 25, 25, 10, 5, 5,
+		0, 0, 0, 20, 20, 0, 0, 0,
+		5, -5, -10, 0, 0, -10, -5, 5,
+		5, 10, 10, -20, -20, 10, 10, 5,
+		0, 0, 0, 0, 0, 0, 0, 0,
+	},
+	chess.Knight: {
+		-50, -40, -30, -30, -30, -30, -40, -50,
+		-40, -20, 0, 0, 0, 0, -20, -40,
+		-30, 0, 10, 15, 15, 10, 0, -30,
+		-30, 5, 15, 20, 20, 15, 5, -30,
+		-30, 0, 15, 20, 20, 15, 0, -30,
+		-30, 5, 10, 15, 15, 10, 5, -30,
+		-40, -20, 0, 5, 5, 0, -20, -40,
+		-50, -40, -30, -30, -30, -30, -40, -50,
+	},
+	chess.Bishop: {
+		-20, -10, -10, -10, -10, -10, -10, -20,
+		-10, 0, 0, 0, 0, 0, 0, -10,
+		-10, 0, 5, 10, 10, 5, 0, -10,
+		-10, 5, 5, 10, 10, 5, 5, -10,
+		-10, 0, 10, 10, 10, 10, 0, -10,
+		-10, 10, 10, 10, 10, 10, 10, -10,
+		-10, 5, 0, 0, 0, 0, 5, -10,
+		-20, -10, -10, -10, -10, -10, -10, -20,
+	},
+	chess.Rook: {
+		0, 0, 0, 0, 0, 0, 0, 0,
+		5, 10, 10, 10, 10, 10, 10, 5,
+		-5, 0, 0, 0, 0, 0, 0, -5,
+		-5, 0, 0, 0, 0, 0, 0, -5,
+		-5, 0, 0, 0, 0, 0, 0, -5,
+		-5, 0, 0, 0, 0, 0, 0, -5,
+		-5, 0, 0, 0, 0, 0, 0, -5,
+		0, 0, 0, 5, 5, 0, 0, 0,
+	},
+	chess.Queen: {
+		-20, -10, -10, -5, -5, -10, -10, -20,
+		-10, 0, 0, 0, 0, 0, 0, -10,
+		-10, 0, 5, 5, 5, 5, 0, -10,
+		-5, 0, 5, 5, 5, 5, 0, -5,
+		0, 0, 5, 5, 5, 5, 0, -5,
+		-10, 5, 5, 5, 5, 5, 0, -10,
+		-10, 0, 5, 0, 0, 0, 0, -10,
+		-20, -10, -10, -5, -5, -10, -10, -20,
+	},
+	chess.King: { // middle game, the king hides behind its pawns
+		-30, -40, -40, -50, -50, -40, -40, -30,
+		-30, -40, -40, -50, -50, -40, -40, -30,
+		-30, -40, -40, -50, -50, -40, -40, -30,
+		-30, -40, -40, -50, -50, -40, -40, -30,
+		-20, -30, -30, -40, -40, -30, -30, -20,
+		-10, -20, -20, -20, -20, -20, -20, -10,
+		20, 20, 0, 0, 0, 0, 20, 20,
+		20, 30, 10, 0, 0, 10, 30, 20,
+	},
+}
+
+// Evaluate is the material and piece square score of the position in centipawns, from the side to move
+func Evaluate(position *chess.Position) int {
+	score := 0
+	for sq, p := range position.Board().SquareMap() {
+		index := int(sq) ^ 56 // a8 is the first entry of the tables
+		if p.Color() == chess.Black {
+			index = int(sq)
+		}
+		value := pieceValues[p.Type()] + pieceSquares[p.Type()][index]
+		if p.Color() == chess.White {
+			score += value
+		} else {
+			score -= value
+		}
+	}
+	if position.Turn() == chess.Black {
+		return -score
+	}
+	return score
+}
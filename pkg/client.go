@@ -7,51 +7,89 @@ import (
 	"github.com/notnil/chess"
 	"github.com/rivo/tview"
 	"log"
+	"math"
 	"net"
+	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Client struct {
-	Game              *chess.Game
-	App               *tview.Application
-	Board             *tview.Table
-	GameLayout        *tview.Grid
-	MenuLayout        *tview.Grid
-	OurClock          *Clock
-	OpponentClock     *Clock
-	Conn              net.Conn
-	In                chan MessageInterface
-	Out               chan MessageInterface
-	selecting         bool
-	lastSelectedPiece chess.Square
-	Role              PlayerRole
-	optionBtn1        *tview.Button // Draw, Accept, Yes
-	optionBtn2        *tview.Button // Resign, Reject, No
-}
-
-var (
+	Game                 *chess.Game
+	App                  *tview.Application
+	Board                *tview.Table
+	GameLayout           *tview.Grid
+	MenuLayout           *tview.Grid
 	ChatTextView         *tview.TextView
 	StatusTextView       *tview.TextView
 	MenuTextView         *tview.TextView
 	HistoryTextView      *tview.TextView
 	OpponentTimeTextView *tview.TextView
 	OurTimeTextView      *tview.TextView
-)
+	EvalTextView         *tview.TextView
+	ReplayTextView       *tview.TextView
+	OurClock             *Clock
+	OpponentClock        *Clock
+	Conn                 net.Conn
+	Local                *ServerConn // the server when the client runs in it, messages don't go through Conn then
+	Addr                 string
+	Identity             MessageIdentify // sent again after reconnecting
+	MatchName            string
+	Session              string // token of our seat in the match
+	In                   chan MessageInterface
+	Out                  chan MessageInterface
+	selecting            bool
+	lastSelectedPiece    chess.Square
+	Role                 PlayerRole
+	InMatch              bool
+	CanBerserk           bool
+	Practice             bool // against the engine
+	AutoQueen            bool // promote without showing the picker
+	Analyzable           bool // the game is over, the engine can review it
+	ShowEval             bool // the evaluation bar is on
+	lastEval             *MessageEval
+	Moves                []string          // of the game on the board, UCI notation
+	positions            []*chess.Position // after each of the moves, the first is the starting position
+	Ply                  int               // position shown while replaying
+	Replaying            bool              // an earlier position is on the board, the game goes on behind it
+	optionBtn1           *tview.Button     // Draw, Accept, Yes
+	optionBtn2           *tview.Button     // Resign, Reject, No
+	hintBtn              *tview.Button
+	evalBtn              *tview.Button
+	analyzeBtn           *tview.Button
+	moveInput            *tview.InputField
+	gameOptions          *tview.Grid
+	closed               chan struct{} // closed once the client is done
+	closeOnce            sync.Once
+}
 
 const (
 	numrows             = 8
 	numcols             = 8
 	numOfSquaresInBoard = 8 * 8
 	ConnQueueSize       = 10
+	ReconnectAttempts   = 10
+	ReconnectInterval   = 2 * time.Second
+	EvalBarWidth        = 20
 	commandlist         = `
 In the light of lazyness to build a good UI, GoChess comes with a list of commands to join a game:
 
-> [green]practice[white] [gray](level)[white]: Single player mode. Level from 1-5 (Default:3) 
+> [green]practice[white] [gray](level)[white]: Single player mode. Level from 1-5 (Default:2) or a rating like [green]1400[white]
+> [green]practice[white] [gray](level) (white|black|random) (time control)[white]: Pick your side, the engine uses its clock in a timed game like [green]5+3[white]
 > [green]ls[white]              : List all the games
-> [green]join [gray](code)[white]     : Join a game.  Live blank to join randomly 
+> [green]join [gray](code)[white]     : Join a game. Leave blank to find an opponent
+> [green]seek [gray](duration) (increment) [rated][white] : Wait for an opponent with the same time control. [green]seek cancel[white] to stop
 > [green]create [gray](code) (duration) (increment)[white] : Create a game with code name, game duration(minutes), increment(seconds)
-> [green]callme [red](name)[white]   : To set your name
+> [green]create [gray](code) (time control)[white] : Also [green]90+30[white], [green]5d3[white] (delay), [green]5b3[white] (Bronstein) or [green]40/5400:1800+30[white] (periods in seconds)
+> [green]tournament [gray](create|join|start|view) (name)[white] : Swiss and round robin tournaments
+> [green]arena [gray](create|join|leave|start|view) (name)[white] : Arena tournaments, play as many games as you can
+> [green]corr [gray](new|view|move|resign) (id)[white] : Correspondence games with days per move
+> [green]leaderboard [gray](speed)[white] : Best rated players. Speed: bullet, blitz, rapid, classical, correspondence
+> [green]history [gray](id)[white]    : List past games. Provide an id to review one
+> [green]analyze [gray](id)[white]    : Engine review of a past game: accuracy, mistakes and blunders
+> [green]callme [red](name)[white]   : To set your name. Log in with an ssh key to keep it
+> [green]set [gray](key) (value)[white] : Show or change your preferences
 > [green]help[white]            : To display this list
 > [green]about[white]           : About the developer of GoChess
 > [green]exit[white]            : To exit`
@@ -63,23 +101,43 @@ func NewClient() *Client {
 	In := make(chan MessageInterface, ConnQueueSize)
 	Out := make(chan MessageInterface, ConnQueueSize)
 	cl := &Client{
-		App:  app,
-		Game: chess.NewGame(chess.UseNotation(chess.UCINotation{})),
-		In:   In,
-		Out:  Out,
+		App:    app,
+		Game:   chess.NewGame(chess.UseNotation(chess.UCINotation{})),
+		In:     In,
+		Out:    Out,
+		closed: make(chan struct{}),
 	}
 	cl.InitGUI()
+	go cl.UpdateTime()
 
 	return cl
 }
 
 func (cl *Client) Disconnect() {
-	cl.App.Stop()
-	cl.Conn.Close()
-	log.Println("Disconnected")
+	cl.closeOnce.Do(func() {
+		close(cl.closed)
+		cl.App.Stop()
+		if cl.Conn != nil {
+			cl.Conn.Close()
+		}
+		if cl.Local != nil {
+			cl.Local.Close()
+		}
+		log.Println("Disconnected")
+	})
+}
+
+// recoverPanic ends the client rather than the process on a panic. The goroutines of the
+// client defer it, a client running in the server would take every game down with it
+func (cl *Client) recoverPanic() {
+	if r := recover(); r != nil {
+		log.Printf("Client crashed: %v\n%s", r, debug.Stack())
+		cl.Disconnect()
+	}
 }
 
 func (cl *Client) HandleAction(action Action) {
+	defer cl.recoverPanic()
 	switch action {
 
 	// Resign
@@ -101,7 +159,7 @@ func (cl *Client) HandleAction(action Action) {
 
 	case ActionDrawPrompt:
 		cl.Out <- MessageGameAction{Action: ActionDrawOffer}
-		StatusTextView.SetText("Draw offer sent!")
+		cl.StatusTextView.SetText("Draw offer sent!")
 
 	case ActionDrawAccept:
 		cl.Out <- MessageGameAction{Action: action}
@@ -120,7 +178,7 @@ func (cl *Client) HandleAction(action Action) {
 
 	case ActionNewGamePrompt:
 		cl.Out <- MessageGameAction{Action: ActionNewGameOffer}
-		StatusTextView.SetText("Invitation sent!")
+		cl.StatusTextView.SetText("Invitation sent!")
 
 	case ActionNewGameAccept:
 		cl.Out <- MessageGameAction{Action: action}
@@ -136,16 +194,43 @@ func (cl *Client) HandleAction(action Action) {
 	case ActionWin, ActionLose, ActionDraw:
 		cl.optionBtn1.SetLabel(string(ActionNewGamePrompt))
 		cl.optionBtn2.SetLabel(string(ActionExit))
+		cl.setAnalyzable()
+		cl.renderHistory()
+
+	case ActionBack:
+		cl.App.SetRoot(cl.MenuLayout, true)
+
+	case ActionBerserk:
+		cl.Out <- MessageGameAction{Action: action}
+		cl.CanBerserk = false
+		cl.optionBtn1.SetLabel(string(ActionDrawPrompt))
+
+	case ActionHint:
+		cl.Out <- MessageGameAction{Action: action}
+		cl.StatusTextView.SetText("Thinking...")
+
+	case ActionEval:
+		cl.ShowEval = !cl.ShowEval
+		cl.renderEval()
+
+	case ActionAnalyze:
+		cl.Out <- MessageGameAction{Action: action}
+		cl.StatusTextView.SetText("Analyzing...")
 
 	case ActionExit:
-		//cl.Out <- MessageGameAction{Action: ActionExit}
-		//cl.App.SetRoot(cl.MenuLayout, true)
-		cl.Disconnect()
+		if cl.InMatch {
+			cl.Out <- MessageGameAction{Action: ActionExit}
+		}
+		cl.InMatch = false
+		cl.OurClock = nil
+		cl.OpponentClock = nil
+		cl.setPractice(false)
+		cl.App.SetRoot(cl.MenuLayout, true)
 
 	default:
 		log.Println("Unknown action")
 	}
-	go cl.App.Draw()
+	cl.draw()
 }
 
 func (cl *Client) InitGUI() {
@@ -165,6 +250,10 @@ func (cl *Client) InitGUI() {
 			go cl.HandleAction(ActionNewGamePrompt)
 		case string(ActionNewGameAccept):
 			go cl.HandleAction(ActionNewGameAccept)
+		case string(ActionBack):
+			go cl.HandleAction(ActionBack)
+		case string(ActionBerserk):
+			go cl.HandleAction(ActionBerserk)
 		}
 	})
 
@@ -183,21 +272,56 @@ func (cl *Client) InitGUI() {
 		}
 	})
 
-	StatusTextView = tview.NewTextView().
+	// Practice tools, only shown against the engine
+	cl.hintBtn = tview.NewButton(string(ActionHint)).SetSelectedFunc(func() {
+		go cl.HandleAction(ActionHint)
+	})
+	cl.evalBtn = tview.NewButton(string(ActionEval)).SetSelectedFunc(func() {
+		go cl.HandleAction(ActionEval)
+	})
+	cl.analyzeBtn = tview.NewButton(string(ActionAnalyze)).SetSelectedFunc(func() {
+		go cl.HandleAction(ActionAnalyze)
+	})
+
+	cl.StatusTextView = tview.NewTextView().
+		SetDynamicColors(true)
+	cl.OpponentTimeTextView = tview.NewTextView().
 		SetDynamicColors(true)
-	OpponentTimeTextView = tview.NewTextView().
+	cl.OurTimeTextView = tview.NewTextView().
 		SetDynamicColors(true)
-	OurTimeTextView = tview.NewTextView().
+	cl.EvalTextView = tview.NewTextView().
 		SetDynamicColors(true)
 
 	gameOptions := tview.NewGrid().
 		SetColumns(4, 11, 1, 11, 3).
-		SetRows(1, 4, 3, 1, -1).
-		AddItem(StatusTextView, 1, 0, 1, 5, 0, 0, false).
+		SetRows(1, 3, 3, 1, 1, 1, -1).
+		AddItem(cl.StatusTextView, 1, 0, 1, 5, 0, 0, false).
 		AddItem(cl.optionBtn1, 2, 1, 1, 1, 0, 0, false).
 		AddItem(cl.optionBtn2, 2, 3, 1, 1, 0, 0, false).
-		AddItem(OpponentTimeTextView, 0, 0, 1, 5, 0, 0, false).
-		AddItem(OurTimeTextView, 3, 0, 1, 5, 0, 0, false)
+		AddItem(cl.OpponentTimeTextView, 0, 0, 1, 5, 0, 0, false).
+		AddItem(cl.OurTimeTextView, 3, 0, 1, 5, 0, 0, false).
+		AddItem(cl.EvalTextView, 5, 0, 1, 5, 0, 0, false)
+	cl.gameOptions = gameOptions
+
+	// Typed moves, Tab on the board gets here and Escape goes back
+	cl.moveInput = tview.NewInputField().
+		SetLabel("[yellow]Move:[white] ").
+		SetPlaceholder("Nf3, exd5, O-O, g1f3").
+		SetAutocompleteFunc(func(text string) []string {
+			if !cl.isTurn() {
+				return nil
+			}
+			return CompleteMoves(cl.Game.Position(), text)
+		})
+	cl.moveInput.SetDoneFunc(func(key tcell.Key) {
+		switch key {
+		case tcell.KeyEnter:
+			cl.submitMove(cl.moveInput.GetText())
+		case tcell.KeyEscape, tcell.KeyTab:
+			cl.App.SetFocus(cl.Board)
+		}
+	})
+	gameOptions.AddItem(cl.moveInput, 6, 0, 1, 5, 0, 0, false)
 
 	messageInput := tview.NewInputField()
 	messageInput.SetLabel("[red]>[red] ").
@@ -206,7 +330,7 @@ func (cl *Client) InitGUI() {
 			messageInput.SetText("")
 		})
 
-	ChatTextView = tview.NewTextView().
+	cl.ChatTextView = tview.NewTextView().
 		SetScrollable(true).
 		SetDynamicColors(true).
 		SetWordWrap(true)
@@ -214,12 +338,39 @@ func (cl *Client) InitGUI() {
 	chatGrid := tview.NewGrid().
 		SetColumns(60).
 		SetRows(9, 1, 1).
-		AddItem(ChatTextView, 0, 0, 1, 1, 0, 0, false).
+		AddItem(cl.ChatTextView, 0, 0, 1, 1, 0, 0, false).
 		AddItem(messageInput, 2, 0, 1, 1, 0, 0, false)
 
-	HistoryTextView = tview.NewTextView().
+	cl.HistoryTextView = tview.NewTextView().
+		SetDynamicColors(true).
+		SetScrollable(true)
+	cl.ReplayTextView = tview.NewTextView().
 		SetDynamicColors(true)
 
+	// Step through the moves, the arrow keys on the board do the same
+	navigation := tview.NewGrid().
+		SetColumns(3, 1, 3, 1, 3, 1, 3)
+	for i, step := range []struct {
+		label string
+		ply   func() int
+	}{
+		{"|<", func() int { return 0 }},
+		{"<", func() int { return cl.Ply - 1 }},
+		{">", func() int { return cl.Ply + 1 }},
+		{">|", func() int { return len(cl.Moves) }},
+	} {
+		ply := step.ply
+		navigation.AddItem(tview.NewButton(step.label).SetSelectedFunc(func() {
+			cl.replayTo(ply())
+		}), 0, 2*i, 1, 1, 0, 0, false)
+	}
+
+	historyPanel := tview.NewGrid().
+		SetRows(1, -1, 1).
+		AddItem(cl.ReplayTextView, 0, 0, 1, 1, 0, 0, false).
+		AddItem(cl.HistoryTextView, 1, 0, 1, 1, 0, 0, false).
+		AddItem(navigation, 2, 0, 1, 1, 0, 0, false)
+
 	board := tview.NewTable()
 
 	gameLayout := tview.NewGrid().
@@ -228,7 +379,7 @@ func (cl *Client) InitGUI() {
 		AddItem(board, 1, 1, 1, 1, 0, 0, true).
 		AddItem(gameOptions, 1, 2, 1, 1, 0, 0, false).
 		AddItem(chatGrid, 2, 1, 1, 2, 0, 0, false).
-		AddItem(HistoryTextView, 1, 3, 2, 1, 0, 0, false)
+		AddItem(historyPanel, 1, 3, 2, 1, 0, 0, false)
 	gameLayout.Box.SetBackgroundColor(tcell.ColorBlack)
 
 	cl.Board = board
@@ -241,23 +392,25 @@ func (cl *Client) InitGUI() {
 		SetDoneFunc(func(key tcell.Key) {
 			command := strings.TrimSpace(strings.ToLower(menuInput.GetText()))
 			commands := strings.Split(command, " ")
+			raw := strings.Fields(menuInput.GetText()) // moves in algebraic notation are case sensitive
 			menuInput.SetText("")
 			switch commands[0] {
 			case "practice":
-				var level string
-				//var args []string
-				if len(commands) > 1 {
-					level = commands[1]
-				} else {
-					level = "2"
-				}
-
-				args := []string{level}
-				cl.Out <- MessageGameCommand{Command: CommandPractice, Argument: args}
+				cl.Out <- MessageGameCommand{Command: CommandPractice, Argument: commands[1:]}
 
 			case "ls":
 				cl.Out <- MessageGameCommand{Command: CommandLs}
 
+			case "history":
+				var args []string
+				if len(commands) > 1 {
+					args = append(args, commands[1])
+				}
+				cl.Out <- MessageGameCommand{Command: CommandHistory, Argument: args}
+
+			case "analyze":
+				cl.Out <- MessageGameCommand{Command: CommandAnalyze, Argument: commands[1:]}
+
 			case "join":
 				var roomName string
 				//var args []string
@@ -268,6 +421,18 @@ func (cl *Client) InitGUI() {
 				args := []string{roomName}
 				cl.Out <- MessageGameCommand{Command: CommandJoin, Argument: args}
 
+			case "tournament":
+				cl.Out <- MessageGameCommand{Command: CommandTournament, Argument: commands[1:]}
+
+			case "arena":
+				cl.Out <- MessageGameCommand{Command: CommandArena, Argument: commands[1:]}
+
+			case "corr":
+				cl.Out <- MessageGameCommand{Command: CommandCorrespondence, Argument: raw[1:]}
+
+			case "seek":
+				cl.Out <- MessageGameCommand{Command: CommandSeek, Argument: commands[1:]}
+
 			case "create":
 				var args []string
 				if len(commands) > 1 {
@@ -293,44 +458,50 @@ func (cl *Client) InitGUI() {
 					args := []string{name}
 					cl.Out <- MessageGameCommand{Command: CommandCallme, Argument: args}
 				} else {
-					currentText := MenuTextView.GetText(false)
-					MenuTextView.
+					currentText := cl.MenuTextView.GetText(false)
+					cl.MenuTextView.
 						SetText(fmt.Sprintf("%s\n%s", currentText, "Please provide your name after [green]callme[white] command")).
 						ScrollToEnd()
 				}
 
+			case "leaderboard":
+				cl.Out <- MessageGameCommand{Command: CommandLeaderboard, Argument: commands[1:]}
+
+			case "set":
+				cl.Out <- MessageGameCommand{Command: CommandSet, Argument: commands[1:]}
+
 			case "exit":
 				cl.Disconnect()
 
 			case "about":
-				currentText := MenuTextView.GetText(false)
+				currentText := cl.MenuTextView.GetText(false)
 				aboutText := `[green]Github[white]  : github.com/qnkhuat
 [green]Website[white] : ngockhuat.me
 [green]Twitter[white] : @qnkhuat
 [green]Email[white]   : qn.khuat@gmail.com
 Give GoChess a star if you like it! [green]github.com/qnkhuat/chessterm[white]
 				`
-				MenuTextView.
+				cl.MenuTextView.
 					SetText(fmt.Sprintf("%s\n%s", currentText, aboutText)).
 					ScrollToEnd()
 
 			case "help":
-				currentText := MenuTextView.GetText(false)
-				MenuTextView.
+				currentText := cl.MenuTextView.GetText(false)
+				cl.MenuTextView.
 					SetText(fmt.Sprintf("%s\n%s", currentText, commandlist)).
 					ScrollToEnd()
 
 			default:
-				currentText := MenuTextView.GetText(false)
+				currentText := cl.MenuTextView.GetText(false)
 				helpText := "Invalid command. Try help"
-				MenuTextView.
+				cl.MenuTextView.
 					SetText(fmt.Sprintf("%s\n%s", currentText, helpText)).
 					ScrollToEnd()
 
 			}
 		})
 
-	MenuTextView = tview.NewTextView().
+	cl.MenuTextView = tview.NewTextView().
 		SetText("WELCOME TO [green]GOCHESS.CLUB[white]" + commandlist).
 		SetScrollable(true).
 		SetDynamicColors(true).
@@ -340,7 +511,7 @@ Give GoChess a star if you like it! [green]github.com/qnkhuat/chessterm[white]
 	menuLayout := tview.NewGrid().
 		SetRows(-1, 15, 1, 1, -1).
 		SetColumns(-1, 66, -1).
-		AddItem(MenuTextView, 1, 1, 1, 1, 0, 0, false).
+		AddItem(cl.MenuTextView, 1, 1, 1, 1, 0, 0, false).
 		AddItem(menuInput, 3, 1, 1, 1, 0, 0, true)
 	menuLayout.Box.SetBackgroundColor(tcell.ColorBlack)
 
@@ -350,6 +521,25 @@ Give GoChess a star if you like it! [green]github.com/qnkhuat/chessterm[white]
 func (cl *Client) initBoard() {
 	cl.renderBoard()
 	cl.Board.SetSelectable(true, true)
+	cl.Board.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		// Plain arrows move the cursor of a player, modifiers always step through the moves
+		stepping := !cl.playing() || event.Modifiers()&(tcell.ModShift|tcell.ModCtrl|tcell.ModAlt) != 0
+		switch {
+		case event.Key() == tcell.KeyLeft && stepping:
+			cl.replayTo(cl.Ply - 1)
+		case event.Key() == tcell.KeyRight && stepping:
+			cl.replayTo(cl.Ply + 1)
+		case event.Key() == tcell.KeyHome:
+			cl.replayTo(0)
+		case event.Key() == tcell.KeyEnd:
+			cl.replayTo(len(cl.Moves))
+		case event.Key() == tcell.KeyTab:
+			cl.App.SetFocus(cl.moveInput)
+		default:
+			return event
+		}
+		return nil
+	})
 	cl.Board.Select(0, 0).SetDoneFunc(func(key tcell.Key) {
 		if key == tcell.KeyEscape {
 			cl.Disconnect()
@@ -358,6 +548,10 @@ func (cl *Client) initBoard() {
 			cl.Board.SetSelectable(true, true)
 		}
 	}).SetSelectionChangedFunc(func(row, col int) {
+		if cl.Replaying { // Back to the game rather than moving in the past
+			cl.replayTo(len(cl.Moves))
+			return
+		}
 		sq := cl.posToSquare(row, col)
 		p := cl.Game.Position().Board().Piece(sq)
 		if (!cl.selecting && p == chess.NoPiece) ||
@@ -375,7 +569,9 @@ func (cl *Client) initBoard() {
 				move := fmt.Sprintf("%s%s", cl.lastSelectedPiece.String(), sq.String())
 				validMoves := cl.Game.ValidMoves()
 				isValid := false
-				if p.Type() == chess.Pawn && ((move[1] == '7' && move[3] == '8') || move[1] == '2' && move[3] == '1') { // Auto promoting to Queen
+				moving := cl.Game.Position().Board().Piece(cl.lastSelectedPiece)
+				promotion := moving.Type() == chess.Pawn && (sq.Rank() == chess.Rank8 || sq.Rank() == chess.Rank1)
+				if promotion { // Any piece would do to check the move
 					move += "q"
 				}
 				for _, validMove := range validMoves {
@@ -389,13 +585,17 @@ func (cl *Client) initBoard() {
 
 					cl.selecting = false
 					cl.lastSelectedPiece = 0
-					StatusTextView.SetText("Illegal move!")
+					cl.StatusTextView.SetText("Illegal move!")
 
 				} else { // success
 					last_row, last_col := cl.squareToPos(cl.lastSelectedPiece)
 					cl.Board.GetCell(last_row, last_col).SetBackgroundColor(squareToColor(cl.lastSelectedPiece)) // Reset color
 
-					cl.Out <- MessageMove{Move: move}
+					if promotion && !cl.AutoQueen {
+						cl.pickPromotion(strings.TrimSuffix(move, "q"))
+					} else {
+						cl.Out <- MessageMove{Move: move}
+					}
 					cl.lastSelectedPiece = 0
 					cl.selecting = false
 				}
@@ -409,7 +609,7 @@ func (cl *Client) initBoard() {
 }
 
 func (cl *Client) renderBoard() {
-	board := cl.Game.Position().Board()
+	board := cl.position().Board()
 	var (
 		r, f  int
 		color tcell.Color
@@ -459,12 +659,13 @@ func (cl *Client) renderBoard() {
 		}
 	}
 	cl.Board.GetCell(numrows, 0).SetSelectable(false) // The bottom left tile is not used
-	go cl.App.Draw()
+	cl.draw()
 
 }
 
 func (cl *Client) Connect(port string) {
 	log.Printf("Connecting to port: %s", port)
+	cl.Addr = port
 	conn, err := net.Dial("tcp", port)
 
 	if err != nil {
@@ -474,157 +675,578 @@ func (cl *Client) Connect(port string) {
 	cl.Conn = conn
 }
 
+// Identify logs in with the identity of the ssh key
+func (cl *Client) Identify(identity, token string) {
+	cl.Identity = MessageIdentify{Identity: identity, Token: token}
+	cl.Out <- cl.Identity
+}
+
+// draw redraws the screen from any goroutine. Once the client is closed nobody draws anymore,
+// a queued draw would wait forever
+func (cl *Client) draw() {
+	go func() {
+		defer cl.recoverPanic()
+		select {
+		case <-cl.closed:
+		default:
+			cl.App.Draw()
+		}
+	}()
+}
+
+// Reconnect dials the server again after the connection dropped and takes back our seat
+func (cl *Client) Reconnect() bool {
+	for attempt := 1; attempt <= ReconnectAttempts; attempt++ {
+		select {
+		case <-cl.closed: // We hung up ourselves
+			return false
+		default:
+		}
+		cl.StatusTextView.SetText(fmt.Sprintf("Connection lost, reconnecting (%d/%d)...", attempt, ReconnectAttempts))
+		cl.draw()
+		select {
+		case <-cl.closed: // We hung up ourselves
+			return false
+		case <-time.After(ReconnectInterval):
+		}
+
+		conn, err := net.Dial("tcp", cl.Addr)
+		if err != nil {
+			log.Printf("Failed to reconnect: %v", err)
+			continue
+		}
+		cl.Conn = conn
+		log.Printf("Reconnected to %s", cl.Addr)
+		if cl.Identity.Identity != "" {
+			cl.Out <- cl.Identity
+		}
+		if cl.InMatch && cl.Session != "" {
+			cl.Out <- MessageReconnect{Match: cl.MatchName, Token: cl.Session}
+		} else {
+			cl.StatusTextView.SetText("Reconnected!")
+		}
+		return true
+	}
+	return false
+}
+
 func (cl *Client) HandleWrite() {
-	for command := range cl.Out {
-		commandData := Encode(command)
-		commandTransport := MessageTransport{MsgType: command.Type(), Data: commandData}
-		b := Encode(commandTransport)
-		if b[len(b)-1] != '\n' { // EOF
-			b = append(b, '\n')
+	defer cl.recoverPanic()
+	for {
+		var command MessageInterface
+		select {
+		case <-cl.closed:
+			return
+		case command = <-cl.Out:
+		}
+		if cl.Local != nil {
+			if !cl.Local.Deliver(command) {
+				return
+			}
+			continue
 		}
 		if cl.Conn == nil {
 			return
 		}
-		if _, err := cl.Conn.Write(b); err != nil {
-			log.Fatal(err)
+		if _, err := cl.Conn.Write(EncodeLine(command)); err != nil {
+			// The reader notices the dropped connection and reconnects
+			log.Printf("Failed to send a msg type %s: %v", command.Type(), err)
+			continue
 		}
 		log.Printf("Send a msg type :%s", command.Type())
 	}
 }
 
 func (cl *Client) UpdateTime() {
-	tick := time.NewTicker(time.Second)
+	defer cl.recoverPanic()
+	tick := time.NewTicker(ClockPrecision)
+	defer tick.Stop()
+	var ours, theirs string
 	for {
 		select {
+		case <-cl.closed:
+			return
 		case <-tick.C:
-			OurTimeTextView.SetText(fmt.Sprintf("[yellow]%s", cl.OurClock))
-			OpponentTimeTextView.SetText(fmt.Sprintf("[yellow]%s", cl.OpponentClock))
-			go cl.App.Draw()
+			if cl.OurClock == nil || cl.OpponentClock == nil { // Not in a match
+				continue
+			}
+			// Only draw when the clocks show something new
+			if cl.OurClock.String() == ours && cl.OpponentClock.String() == theirs {
+				continue
+			}
+			ours, theirs = cl.OurClock.String(), cl.OpponentClock.String()
+			cl.OurTimeTextView.SetText(fmt.Sprintf("[yellow]%s", ours))
+			cl.OpponentTimeTextView.SetText(fmt.Sprintf("[yellow]%s", theirs))
+			cl.draw()
 		}
 	}
 }
 
+// syncClocks shows the remaining times sent by the server, the clock of the side to move
+// counts down until the next update. Clocks only run once the game has started
+func (cl *Client) syncClocks(white, black time.Duration, started bool) {
+	if cl.OurClock == nil || cl.OpponentClock == nil {
+		return
+	}
+	ours, theirs := white, black
+	if cl.Role == Black {
+		ours, theirs = black, white
+	}
+	ourTurn := (cl.Game.Position().Turn() == chess.Black) == (cl.Role == Black)
+	cl.OurClock.Sync(ours, started && ourTurn)
+	cl.OpponentClock.Sync(theirs, started && !ourTurn)
+}
+
+// HandleRead reads the messages of the server until the connection drops and can't be recovered
 func (cl *Client) HandleRead() {
 	defer cl.Disconnect()
+	defer cl.recoverPanic()
+	if cl.Local != nil { // Nothing to reconnect to, the server let us go
+		cl.readLocal()
+		return
+	}
+	for {
+		cl.readConn()
+		if !cl.Reconnect() {
+			return
+		}
+	}
+}
+
+func (cl *Client) readConn() {
 	scanner := bufio.NewScanner(cl.Conn)
-	var messageTransport MessageTransport
+	scanner.Buffer(make([]byte, 4096), MaxServerLineSize)
 	for scanner.Scan() {
-		Decode(scanner.Bytes(), &messageTransport)
-		log.Printf("Received a message type: %s", messageTransport.MsgType)
-		switch messageTransport.MsgType {
-		case TypeMessageGame:
-			var message MessageGame
-			Decode(messageTransport.Data, &message)
-			cl.Game = GameFromFEN(message.Fen)
-			if message.IsTurn {
-				StatusTextView.SetText("Your turn!")
-				cl.OurClock.Tick()
-				cl.OpponentClock.Pause()
-			} else {
-				StatusTextView.SetText("Opponent turn!")
-				cl.OpponentClock.Tick()
+		var messageTransport MessageTransport
+		if err := Decode(scanner.Bytes(), &messageTransport); err != nil {
+			log.Printf("Skipped a malformed message: %v", err)
+			continue
+		}
+		cl.handleMessage(messageTransport)
+	}
+}
+
+// readLocal takes the messages of the server the client runs in
+func (cl *Client) readLocal() {
+	for {
+		select {
+		case message := <-cl.Local.Out:
+			cl.handleMessage(Transport(message))
+		case <-cl.Local.Done():
+			return
+		case <-cl.closed:
+			return
+		}
+	}
+}
+
+// handleMessage shows what the server says
+func (cl *Client) handleMessage(messageTransport MessageTransport) {
+	log.Printf("Received a message type: %s", messageTransport.MsgType)
+	switch messageTransport.MsgType {
+	case TypeMessagePing:
+		var message MessagePing
+		messageTransport.Decode(&message)
+		cl.Out <- MessagePong{SentAt: message.SentAt}
+
+	case TypeMessageGame:
+		var message MessageGame
+		messageTransport.Decode(&message)
+		game, err := GameFromFEN(message.Fen)
+		if err != nil {
+			log.Printf("Skipped a %s with a bad position: %v", messageTransport.MsgType, err)
+			return
+		}
+		cl.Game = game
+		if cl.Analyzable { // A new game started
+			cl.setPractice(cl.Practice)
+		}
+		if message.IsTurn {
+			cl.StatusTextView.SetText("Your turn!")
+		} else {
+			cl.StatusTextView.SetText("Opponent turn!")
+		}
+		cl.syncClocks(message.WhiteClock, message.BlackClock, len(message.Moves) > 0)
+		cl.optionBtn1.SetLabel(ActionDrawPrompt)
+		cl.optionBtn2.SetLabel(ActionResignPrompt)
+		// Black can still berserk after the first move of white
+		if cl.CanBerserk && cl.Role == Black && len(message.Moves) == 1 {
+			cl.optionBtn1.SetLabel(ActionBerserk)
+		} else {
+			cl.CanBerserk = false
+		}
+		cl.setMoves(message.Moves)
+		cl.renderBoard()
+
+	case TypeMessageError:
+		var message MessageError
+		messageTransport.Decode(&message)
+		log.Printf("Server error: %s", message.Message)
+		if cl.InMatch {
+			cl.StatusTextView.SetText(fmt.Sprintf("[red]%s", message.Message))
+		} else {
+			cl.MenuTextView.SetText(fmt.Sprintf("%s\n[red]%s[white]", cl.MenuTextView.GetText(false), message.Message)).ScrollToEnd()
+		}
+		cl.draw()
+
+	case TypeMessageMoveRejected:
+		var message MessageMoveRejected
+		messageTransport.Decode(&message)
+		game, err := GameFromFEN(message.Fen)
+		if err != nil {
+			log.Printf("Skipped a %s with a bad position: %v", messageTransport.MsgType, err)
+			return
+		}
+		cl.Game = game
+		cl.StatusTextView.SetText(fmt.Sprintf("[red]Move rejected[white]: %s", message.Reason))
+		if cl.Replaying {
+			cl.replayTo(len(cl.Moves))
+		}
+		cl.renderBoard()
+
+	case TypeMessageHint:
+		var message MessageHint
+		messageTransport.Decode(&message)
+		move, err := chess.UCINotation{}.Decode(cl.Game.Position(), message.Move)
+		if err != nil {
+			log.Printf("Invalid hint %s: %v", message.Move, err)
+			return
+		}
+		if cl.Replaying {
+			cl.replayTo(len(cl.Moves))
+		}
+		cl.StatusTextView.SetText(fmt.Sprintf("Hint: [green]%s[white]", chess.AlgebraicNotation{}.Encode(cl.Game.Position(), move)))
+		for _, sq := range []chess.Square{move.S1(), move.S2()} {
+			row, col := cl.squareToPos(sq)
+			cl.Board.GetCell(row, col).SetBackgroundColor(tcell.ColorGreen)
+		}
+		cl.draw()
+
+	case TypeMessageEval:
+		var message MessageEval
+		messageTransport.Decode(&message)
+		cl.lastEval = &message
+		cl.renderEval()
+
+	case TypeMessageAnalysis:
+		var message MessageAnalysis
+		messageTransport.Decode(&message)
+		cl.StatusTextView.SetText(fmt.Sprintf("Analysis of [red]%s[white] is in the chat", message.Id))
+		cl.ChatTextView.SetText(message.Report + "\n" + message.PGN).ScrollToBeginning()
+		cl.draw()
+
+	case TypeMessageArchivedGame:
+		var message MessageArchivedGame
+		messageTransport.Decode(&message)
+		game, err := GameFromMoves(message.Moves)
+		if err != nil {
+			log.Printf("Archived game %s is damaged: %v", message.Id, err)
+		}
+		cl.Game = game
+		cl.Role = Viewer
+		cl.setPractice(false)
+		cl.InMatch = false
+		cl.OurClock = nil
+		cl.OpponentClock = nil
+		cl.App.SetRoot(cl.GameLayout, true)
+		cl.setMoves(message.Moves)
+		cl.renderBoard()
+		cl.StatusTextView.SetText(fmt.Sprintf("[green]%s[white] vs [green]%s[white]\n%s (%s)", message.White, message.Black, message.Result, message.Termination))
+		cl.OpponentTimeTextView.SetText(fmt.Sprintf("[yellow]%s", formatClock(message.BlackClock)))
+		cl.OurTimeTextView.SetText(fmt.Sprintf("[yellow]%s", formatClock(message.WhiteClock)))
+		cl.ChatTextView.SetText(message.PGN).ScrollToBeginning()
+		cl.optionBtn1.SetLabel(ActionBack)
+		cl.optionBtn2.SetLabel(ActionExit)
+		cl.draw()
+
+	case TypeMessageConnect:
+		var message MessageConnect
+		cl.App.SetRoot(cl.GameLayout, true)
+		cl.ChatTextView.SetText("")
+		cl.optionBtn1.SetLabel(ActionDrawPrompt)
+		cl.optionBtn2.SetLabel(ActionResignPrompt)
+		messageTransport.Decode(&message)
+		game, err := GameFromFEN(message.Fen)
+		if err != nil {
+			log.Printf("Skipped a %s with a bad position: %v", messageTransport.MsgType, err)
+			return
+		}
+		cl.Game = game
+		cl.Role = message.Role
+		cl.InMatch = true
+		cl.MatchName = message.Match
+		cl.Session = message.Token
+		cl.CanBerserk = message.Berserk
+		cl.setPractice(message.Practice)
+		cl.AutoQueen = message.AutoQueen
+		if cl.CanBerserk {
+			cl.optionBtn1.SetLabel(ActionBerserk)
+		}
+
+		if cl.Role == Black {
+			cl.OurClock = message.BlackClock
+			cl.OpponentClock = message.WhiteClock
+		} else {
+			cl.OurClock = message.WhiteClock
+			cl.OpponentClock = message.BlackClock
+		}
+		if cl.OurClock == nil || cl.OpponentClock == nil {
+			log.Printf("Skipped a %s without clocks", messageTransport.MsgType)
+			return
+		}
+		cl.OurClock.Sync(cl.OurClock.Remaining, !cl.OurClock.Paused)
+		cl.OpponentClock.Sync(cl.OpponentClock.Remaining, !cl.OpponentClock.Paused)
+
+		if message.IsTurn {
+			cl.StatusTextView.SetText("Your turn!")
+		} else {
+			cl.StatusTextView.SetText("Opponent turn!")
+		}
+		cl.setMoves(message.Moves)
+		cl.renderBoard()
+
+	case TypeMessageGameChat:
+		var message MessageGameChat
+		messageTransport.Decode(&message)
+		currentText := cl.ChatTextView.GetText(false)
+		displayText := fmt.Sprintf("[green]%s[white]: %s", strings.Title(message.Name), message.Message)
+		cl.ChatTextView.
+			SetText(fmt.Sprintf("%s%s", currentText, displayText)).
+			ScrollToEnd()
+		cl.draw()
+
+	case TypeMessageGameStatus:
+		var message MessageGameChat
+		messageTransport.Decode(&message)
+		cl.StatusTextView.SetText(message.Message)
+
+		cl.draw()
+
+	case TypeMessageGameAction:
+		var message MessageGameAction
+		messageTransport.Decode(&message)
+		switch message.Action {
+
+		case ActionWin, ActionLose, ActionDraw:
+			status := string(message.Action)
+			if message.Message != "" {
+				status = fmt.Sprintf("%s by %s", status, message.Message)
+			}
+			cl.StatusTextView.SetText(status)
+			cl.HandleAction(message.Action)
+			cl.draw()
+			if cl.OurClock != nil && cl.OpponentClock != nil { // Gone after Exit or in an archived game
 				cl.OurClock.Pause()
+				cl.OpponentClock.Pause()
 			}
-			cl.optionBtn1.SetLabel(ActionDrawPrompt)
-			cl.optionBtn2.SetLabel(ActionResignPrompt)
-			cl.renderBoard()
-
-			// Render history
-			historyText := ""
-			for i, move := range message.Moves {
-				if i%2 == 0 {
-					historyText += fmt.Sprintf("[blue]%d. [white]%s - ", i/2+1, move)
-				} else {
-					historyText += fmt.Sprintf("%s\n", move)
-				}
+
+		case ActionDrawOffer, ActionNewGameOffer: // Opponent send draw offer
+			cl.HandleAction(message.Action)
+
+		case ActionNewGameAccept:
+			cl.HandleAction(ActionDraw)
+
+		case ActionBerserk: // Message is the role of the berserker
+			clock := cl.OpponentClock
+			if (message.Message == Black.String()) == (cl.Role == Black) {
+				clock = cl.OurClock
 			}
-			HistoryTextView.SetText(historyText)
-
-		case TypeMessageConnect:
-			var message MessageConnect
-			cl.App.SetRoot(cl.GameLayout, true)
-			Decode(messageTransport.Data, &message)
-			cl.Game = GameFromFEN(message.Fen)
-			cl.Role = message.Role
-
-			if cl.Role == Black {
-				cl.OurClock = message.BlackClock
-				cl.OpponentClock = message.WhiteClock
-			} else {
-				cl.OurClock = message.WhiteClock
-				cl.OpponentClock = message.BlackClock
+			if clock != nil {
+				clock.Duration /= 2
+				clock.Remaining = clock.Duration
 			}
-			go cl.OurClock.Run()
-			go cl.OpponentClock.Run()
+			cl.draw()
 
-			if message.IsTurn {
-				StatusTextView.SetText("Your turn!")
-			} else {
-				StatusTextView.SetText("Opponent turn!")
+		}
+	case TypeMessageGameCommand:
+		var message MessageGameCommand
+		messageTransport.Decode(&message)
+		switch message.Command {
+
+		case CommandMessage:
+			if len(message.Argument) == 0 {
+				return
 			}
-			cl.renderBoard()
+			currentText := cl.MenuTextView.GetText(false)
+			cl.MenuTextView.
+				SetText(fmt.Sprintf("%s\n%s", currentText, message.Argument[0])).
+				ScrollToEnd()
+			cl.draw()
 
-			go cl.UpdateTime()
+		}
 
-		case TypeMessageGameChat:
-			var message MessageGameChat
-			Decode(messageTransport.Data, &message)
-			currentText := ChatTextView.GetText(false)
-			displayText := fmt.Sprintf("[green]%s[white]: %s", strings.Title(message.Name), message.Message)
-			ChatTextView.
-				SetText(fmt.Sprintf("%s%s", currentText, displayText)).
-				ScrollToEnd()
-			go cl.App.Draw()
+	default:
+		log.Printf("Received Unknown action")
+	}
+}
+
+// setPractice shows the hint and evaluation buttons in practice games only
+func (cl *Client) setPractice(practice bool) {
+	cl.Practice = practice
+	cl.Analyzable = false
+	cl.lastEval = nil
+	cl.gameOptions.RemoveItem(cl.hintBtn).RemoveItem(cl.evalBtn).RemoveItem(cl.analyzeBtn)
+	if practice {
+		cl.gameOptions.
+			AddItem(cl.hintBtn, 4, 1, 1, 1, 0, 0, false).
+			AddItem(cl.evalBtn, 4, 3, 1, 1, 0, 0, false)
+	}
+	cl.renderEval()
+}
+
+// setAnalyzable puts the analysis in place of the hint once the game is over
+func (cl *Client) setAnalyzable() {
+	if !cl.InMatch || cl.Analyzable {
+		return
+	}
+	cl.Analyzable = true
+	cl.gameOptions.RemoveItem(cl.hintBtn).
+		AddItem(cl.analyzeBtn, 4, 1, 1, 1, 0, 0, false)
+}
 
-		case TypeMessageGameStatus:
-			var message MessageGameChat
-			Decode(messageTransport.Data, &message)
-			StatusTextView.SetText(message.Message)
+func (cl *Client) renderEval() {
+	if !cl.Practice || !cl.ShowEval || cl.lastEval == nil {
+		cl.EvalTextView.SetText("")
+	} else {
+		cl.EvalTextView.SetText(evalBar(*cl.lastEval))
+	}
+	cl.draw()
+}
 
-			go cl.App.Draw()
+// evalBar fills White's share of the bar with its winning chances, as lichess does
+func evalBar(eval MessageEval) string {
+	var share float64
+	var label string
+	switch {
+	case eval.Mate > 0:
+		share, label = 1, fmt.Sprintf("M%d", eval.Mate)
+	case eval.Mate < 0:
+		share, label = 0, fmt.Sprintf("-M%d", -eval.Mate)
+	default:
+		share = 1 / (1 + math.Pow(10, -float64(eval.Score)/400))
+		label = fmt.Sprintf("%+.2f", float64(eval.Score)/100)
+	}
+	white := int(math.Round(share * EvalBarWidth))
+	return fmt.Sprintf("[black:white]%s[white:black]%s[-:-] %s", strings.Repeat(" ", white), strings.Repeat(" ", EvalBarWidth-white), label)
+}
 
-		case TypeMessageGameAction:
-			var message MessageGameAction
-			Decode(messageTransport.Data, &message)
-			switch message.Action {
+// setMoves keeps the moves of the game on the board and goes back to the live position
+func (cl *Client) setMoves(moves []string) {
+	cl.Moves = moves
+	game, err := GameFromMoves(moves)
+	if err != nil {
+		log.Printf("Failed to replay the moves: %v", err)
+	}
+	cl.positions = game.Positions()
+	cl.Ply = len(moves)
+	cl.Replaying = false
+	cl.renderHistory()
+}
 
-			case ActionWin, ActionLose, ActionDraw:
-				status := string(message.Action)
-				if message.Message != "" {
-					status = fmt.Sprintf("%s by %s", status, message.Message)
-				}
-				StatusTextView.SetText(status)
-				cl.HandleAction(message.Action)
-				go cl.App.Draw()
-				cl.OurClock.Reset()
-				cl.OpponentClock.Reset()
+// replayTo shows the position after ply moves, the last one is live
+func (cl *Client) replayTo(ply int) {
+	if ply < 0 {
+		ply = 0
+	} else if ply > len(cl.Moves) {
+		ply = len(cl.Moves)
+	}
+	cl.Ply = ply
+	cl.Replaying = ply < len(cl.Moves)
+	cl.renderBoard()
+	cl.renderHistory()
+}
 
-			case ActionDrawOffer, ActionNewGameOffer: // Opponent send draw offer
-				cl.HandleAction(message.Action)
+// position is the one on the board, an earlier one while replaying
+func (cl *Client) position() *chess.Position {
+	if cl.Replaying && cl.Ply < len(cl.positions) {
+		return cl.positions[cl.Ply]
+	}
+	return cl.Game.Position()
+}
 
-			case ActionNewGameAccept:
-				cl.HandleAction(ActionDraw)
+// playing is when the arrow keys pick the pieces to move
+func (cl *Client) playing() bool {
+	return cl.InMatch && cl.Role != Viewer && !cl.Analyzable
+}
 
+// pickPromotion asks what the pawn of move, in UCI without the piece, becomes
+func (cl *Client) pickPromotion(move string) {
+	pieces := []string{"Queen", "Rook", "Bishop", "Knight"}
+	modal := tview.NewModal().
+		SetText("Promote to").
+		AddButtons(pieces).
+		SetDoneFunc(func(index int, label string) {
+			cl.App.SetRoot(cl.GameLayout, true).SetFocus(cl.Board)
+			if index < 0 || index >= len(pieces) { // Escape
+				cl.StatusTextView.SetText("Promotion cancelled")
+				return
 			}
-		case TypeMessageGameCommand:
-			var message MessageGameCommand
-			Decode(messageTransport.Data, &message)
-			switch message.Command {
-
-			case CommandMessage:
-				currentText := MenuTextView.GetText(false)
-				MenuTextView.
-					SetText(fmt.Sprintf("%s\n%s", currentText, message.Argument[0])).
-					ScrollToEnd()
-				go cl.App.Draw()
+			cl.Out <- MessageMove{Move: move + string("qrbn"[index])}
+		})
+	cl.App.SetRoot(modal, false)
+}
+
+func (cl *Client) isTurn() bool {
+	return cl.playing() && (cl.Game.Position().Turn() == chess.Black) == (cl.Role == Black)
+}
 
+// submitMove sends a move typed in SAN or UCI, the text stays to be fixed when it's not legal
+func (cl *Client) submitMove(text string) {
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+	switch {
+	case !cl.playing():
+		cl.StatusTextView.SetText("[red]You are not playing this game")
+	case !cl.isTurn():
+		cl.StatusTextView.SetText("[red]Not your turn!")
+	default:
+		move, err := ParseMove(cl.Game.Position(), text)
+		if err != nil && cl.AutoQueen { // e8 is e8=Q
+			if queen, queenErr := ParseMove(cl.Game.Position(), text+"q"); queenErr == nil {
+				move, err = queen, nil
 			}
+		}
+		if err != nil {
+			cl.StatusTextView.SetText(fmt.Sprintf("[red]%s", err))
+			break
+		}
+		if cl.Replaying {
+			cl.replayTo(len(cl.Moves))
+		}
+		cl.Out <- MessageMove{Move: move.String()}
+		cl.moveInput.SetText("")
+	}
+	cl.draw()
+}
 
-		default:
-			log.Printf("Received Unknown action")
+func (cl *Client) renderHistory() {
+	historyText := ""
+	for i, move := range cl.Moves {
+		if cl.Replaying && i == cl.Ply-1 { // the move that led to the position on the board
+			move = fmt.Sprintf("[black:yellow]%s[-:-]", move)
+		}
+		if i%2 == 0 {
+			historyText += fmt.Sprintf("[blue]%d. [white]%s - ", i/2+1, move)
+		} else {
+			historyText += fmt.Sprintf("%s\n", move)
 		}
 	}
+	cl.HistoryTextView.SetText(historyText)
+	switch {
+	case cl.Replaying:
+		cl.ReplayTextView.SetText(fmt.Sprintf("[yellow]Move %d/%d", cl.Ply, len(cl.Moves)))
+		cl.HistoryTextView.ScrollTo((cl.Ply-1)/2, 0)
+	case cl.InMatch && !cl.Analyzable:
+		cl.ReplayTextView.SetText("[green]● Live")
+		cl.HistoryTextView.ScrollToEnd()
+	default:
+		cl.ReplayTextView.SetText("[green]Final position")
+		cl.HistoryTextView.ScrollToEnd()
+	}
+	cl.draw()
 }
+
 func (cl *Client) posToSquare(row, col int) chess.Square {
 	// A1 is square 0
 	if cl.Role == White || cl.Role == Viewer { // decending order if is white
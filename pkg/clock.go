@@ -5,50 +5,152 @@ import (
 	"time"
 )
 
+const (
+	ClockPrecision     = 100 * time.Millisecond // how often the clients redraw the clocks
+	MaxLagCompensation = time.Second            // most network lag given back to a player on a move
+)
+
+// A chess clock. The server's clocks are the only ones that count: a running clock remembers
+// when it was started and charges the elapsed time when it's stopped. The clients only interpolate
+// between the remaining times the server sends them
 type Clock struct {
-	Duration  time.Duration
-	Remaining time.Duration
-	Increment time.Duration
+	Duration  time.Duration // of the first period
+	Remaining time.Duration // remaining time when the clock was last started or stopped
+	Increment time.Duration // bonus of the current period, a delay when Delay is set
+	Delay     DelayKind
 	Paused    bool
+	Control   TimeControl
+	Period    int // current period of the control
+	Moves     int
+	PeriodEnd int           // number of moves that ends the current period, 0 if it lasts until the end
+	StartedAt time.Time     `json:"-"` // carries the monotonic clock reading, never sent over the wire
+	used      time.Duration // charged by the last Stop
 }
 
 func (cl *Clock) String() string {
-	return fmt.Sprintf("%d:%02d", int(cl.Remaining.Minutes()), int(cl.Remaining.Seconds())%60)
+	left := cl.Left()
+	if left < 10*time.Second { // Every tenth counts in a flag race
+		return fmt.Sprintf("%d:%02d.%d", int(left.Minutes()), int(left.Seconds())%60, int(left/(100*time.Millisecond))%10)
+	}
+	return fmt.Sprintf("%d:%02d", int(left.Minutes()), int(left.Seconds())%60)
 }
 
-func NewClock(duration, increment time.Duration) *Clock {
-	cl := &Clock{
-		Duration:  duration,
-		Remaining: duration,
-		Increment: increment,
-		Paused:    true,
+func NewClock(tc TimeControl) *Clock {
+	cl := &Clock{Control: tc}
+	if len(tc.Periods) > 0 {
+		cl.Duration = tc.Periods[0].Duration
 	}
-	go cl.Run()
+	cl.Reset()
 	return cl
 }
 
-func (cl *Clock) Run() {
-	tick := time.NewTicker(time.Second)
-	for {
-		select {
-		case <-tick.C:
-			if !cl.Paused && cl.Remaining > time.Duration(0) {
-				cl.Remaining -= time.Second
-			}
-		}
+// Left is the remaining time right now
+func (cl *Clock) Left() time.Duration {
+	return cl.LeftAt(time.Now())
+}
+
+func (cl *Clock) LeftAt(now time.Time) time.Duration {
+	left := cl.Remaining
+	if !cl.Paused {
+		left -= cl.charge(now.Sub(cl.StartedAt))
 	}
+	if left < 0 {
+		return 0
+	}
+	return left
 }
 
-func (cl *Clock) Tick() {
+// Start runs the clock from now on
+func (cl *Clock) Start(now time.Time) {
+	if !cl.Paused {
+		return
+	}
+	cl.StartedAt = now
 	cl.Paused = false
-	cl.Remaining += cl.Increment
 }
 
-func (cl *Clock) Pause() {
+// Stop charges the time elapsed since the clock was started, minus the network lag of the player
+func (cl *Clock) Stop(now time.Time, lag time.Duration) {
+	if cl.Paused {
+		return
+	}
+	if lag > MaxLagCompensation {
+		lag = MaxLagCompensation
+	}
+	used := cl.charge(now.Sub(cl.StartedAt) - lag)
+	cl.used = used
+	cl.Remaining -= used
+	if cl.Remaining < 0 {
+		cl.Remaining = 0
+	}
 	cl.Paused = true
 }
 
+// The part of the elapsed time that counts, a simple delay is free
+func (cl *Clock) charge(elapsed time.Duration) time.Duration {
+	if cl.Delay == DelaySimple {
+		elapsed -= cl.Increment
+	}
+	if elapsed < 0 {
+		return 0
+	}
+	return elapsed
+}
+
+// Moved credits the bonus of the move just played, then moves on to the next period when it's due
+func (cl *Clock) Moved() {
+	switch cl.Delay {
+	case DelayNone:
+		cl.Remaining += cl.Increment
+	case DelayBronstein:
+		if cl.used < cl.Increment {
+			cl.Remaining += cl.used
+		} else {
+			cl.Remaining += cl.Increment
+		}
+	}
+	cl.Moves++
+	if cl.PeriodEnd == 0 || cl.Moves < cl.PeriodEnd {
+		return
+	}
+	if cl.Period+1 < len(cl.Control.Periods) { // The last period repeats
+		cl.Period++
+	}
+	period := cl.Control.Periods[cl.Period]
+	cl.Remaining += period.Duration
+	cl.Increment, cl.Delay = period.Bonus, period.Delay
+	if period.Moves > 0 {
+		cl.PeriodEnd += period.Moves
+	} else {
+		cl.PeriodEnd = 0
+	}
+}
+
+func (cl *Clock) Pause() {
+	cl.Stop(time.Now(), 0)
+}
+
 func (cl *Clock) Reset() {
 	cl.Remaining = cl.Duration
-	cl.Pause()
+	cl.Paused = true
+	cl.Period, cl.Moves, cl.PeriodEnd = 0, 0, 0
+	if len(cl.Control.Periods) > 0 {
+		period := cl.Control.Periods[0]
+		cl.Increment, cl.Delay, cl.PeriodEnd = period.Bonus, period.Delay, period.Moves
+	}
+}
+
+// Snapshot is a copy of the clock with the remaining time as of now, ready to be sent to a client
+func (cl *Clock) Snapshot() *Clock {
+	snapshot := *cl
+	snapshot.Remaining = cl.Left()
+	snapshot.StartedAt = time.Time{}
+	return &snapshot
+}
+
+// Sync sets the remaining time sent by the server, a running clock counts down from now
+func (cl *Clock) Sync(remaining time.Duration, running bool) {
+	cl.Remaining = remaining
+	cl.Paused = !running
+	cl.StartedAt = time.Now()
 }
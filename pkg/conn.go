@@ -0,0 +1,275 @@
+package pkg
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PingInterval    = 5 * time.Second
+	ConnErrorBudget = 10               // malformed messages a client can send before it's disconnected
+	SendQueueSize   = 64               // messages waiting for a client, one that lets more pile up is disconnected
+	WriteTimeout    = 10 * time.Second // a client that doesn't take a message in that time is gone
+)
+
+// Pings are timed with the monotonic clock, counted from here
+var processStart = time.Now()
+
+// A client connected to the server. It's owned by the lobby (Server.HandleConn)
+// or by the match the client is playing, never both at the same time
+type ServerConn struct {
+	lag        int64    // nanoseconds, see Lag. First for the alignment of atomic operations
+	Conn       net.Conn // nil for local clients
+	Name       string
+	Identity   string                  // ssh key fingerprint, empty for guests
+	guestKey   string                  // reserves the seats of a guest, see SeatKey
+	In         <-chan MessageTransport // decoded messages from client, closed when the connection drops
+	Out        chan MessageInterface   // messages to client
+	Assign     chan Assignment         // seats offered to this client, taken when it's in the lobby
+	closed     chan struct{}
+	errors     int                   // malformed messages so far
+	local      chan MessageTransport // messages of a local client, see Deliver
+	hangup     chan struct{}         // closed to disconnect a local client
+	hangupOnce sync.Once
+}
+
+// A seat in a match given to a client by the matchmaker
+type Assignment struct {
+	Match *Match
+	Role  PlayerRole
+}
+
+func NewServerConn(conn net.Conn) *ServerConn {
+	in := make(chan MessageTransport)
+	sconn := &ServerConn{
+		Conn:     conn,
+		In:       in,
+		Out:      make(chan MessageInterface, SendQueueSize),
+		Assign:   make(chan Assignment, 1),
+		closed:   make(chan struct{}),
+		guestKey: "guest:" + NewToken(),
+	}
+	go sconn.HandleRead(in)
+	go sconn.HandleWrite()
+	go sconn.Ping()
+	return sconn
+}
+
+// NewLocalServerConn is a client running in the server process, like the TUI of ssh sessions.
+// Messages are passed as they are: the client hands its messages to Deliver and reads Out
+func NewLocalServerConn() *ServerConn {
+	in := make(chan MessageTransport)
+	sconn := &ServerConn{
+		In:       in,
+		Out:      make(chan MessageInterface, SendQueueSize),
+		Assign:   make(chan Assignment, 1),
+		closed:   make(chan struct{}),
+		local:    make(chan MessageTransport),
+		hangup:   make(chan struct{}),
+		guestKey: "guest:" + NewToken(),
+	}
+	go sconn.handleLocal(in)
+	return sconn
+}
+
+// Deliver hands a message of a local client to the server. False once the connection is closed
+func (sconn *ServerConn) Deliver(message MessageInterface) bool {
+	if _, ok := clientMessage(message.Type()); !ok {
+		log.Printf("Dropped a %s of local client %s", message.Type(), sconn.Name)
+		return true
+	}
+	select {
+	case sconn.local <- Transport(message):
+		return true
+	case <-sconn.closed:
+		return false
+	}
+}
+
+// handleLocal is HandleRead for a local client, until it hangs up
+func (sconn *ServerConn) handleLocal(in chan MessageTransport) {
+	defer close(in)
+	defer close(sconn.closed)
+	for {
+		select {
+		case messageTransport := <-sconn.local:
+			select {
+			case in <- messageTransport:
+			case <-sconn.hangup:
+				return
+			}
+		case <-sconn.hangup:
+			return
+		}
+	}
+}
+
+// Send queues a message for the client without waiting. A client whose queue is full
+// stopped reading, it's disconnected rather than holding up the match
+func (sconn *ServerConn) Send(message MessageInterface) bool {
+	select {
+	case sconn.Out <- message:
+		return true
+	default:
+		sconn.Close()
+		return false
+	}
+}
+
+// Close disconnects the client, In is closed once it's gone
+func (sconn *ServerConn) Close() {
+	if sconn.Conn != nil {
+		sconn.Conn.Close()
+		return
+	}
+	if sconn.hangup == nil { // Not connected, like the players of a restored match
+		return
+	}
+	sconn.hangupOnce.Do(func() {
+		close(sconn.hangup)
+	})
+}
+
+// Lag is the estimated one way network delay to the client
+func (sconn *ServerConn) Lag() time.Duration {
+	return time.Duration(atomic.LoadInt64(&sconn.lag))
+}
+
+// Ping measures the lag until the connection drops
+func (sconn *ServerConn) Ping() {
+	tick := time.NewTicker(PingInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-sconn.closed:
+			return
+		case <-tick.C:
+			select {
+			case sconn.Out <- MessagePing{SentAt: time.Since(processStart)}:
+			case <-sconn.closed:
+				return
+			}
+		}
+	}
+}
+
+// The lag is half of the round trip, smoothed over the last pongs
+func (sconn *ServerConn) handlePong(pong MessagePong) {
+	lag := (time.Since(processStart) - pong.SentAt) / 2
+	if lag < 0 {
+		return
+	}
+	if old := sconn.Lag(); old != 0 {
+		lag = (4*old + lag) / 5
+	}
+	atomic.StoreInt64(&sconn.lag, int64(lag))
+}
+
+// AssignSeat offers a seat to the client, the lobby takes it as soon as the client is there.
+// It replaces a seat offered earlier that hasn't been taken yet
+func (sconn *ServerConn) AssignSeat(assignment Assignment) {
+	for {
+		select {
+		case sconn.Assign <- assignment:
+			return
+		default:
+			select {
+			case <-sconn.Assign:
+			default:
+			}
+		}
+	}
+}
+
+// Key identifies the client: its ssh key if any, its name otherwise
+func (sconn *ServerConn) Key() string {
+	if sconn.Identity != "" {
+		return sconn.Identity
+	}
+	return "guest:" + sconn.Name
+}
+
+// SeatKey reserves a seat in a match for the client: its ssh key if any.
+// Anyone can take the name of a guest, so a guest gets a key of this connection only
+func (sconn *ServerConn) SeatKey() string {
+	if sconn.Identity != "" {
+		return sconn.Identity
+	}
+	return sconn.guestKey
+}
+
+// Done is closed when the connection drops
+func (sconn *ServerConn) Done() <-chan struct{} {
+	return sconn.closed
+}
+
+// Closed reports whether the connection has dropped
+func (sconn *ServerConn) Closed() bool {
+	select {
+	case <-sconn.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (sconn *ServerConn) HandleRead(in chan MessageTransport) {
+	defer close(in)
+	defer close(sconn.closed)
+	defer sconn.Conn.Close()
+	scanner := bufio.NewScanner(sconn.Conn)
+	scanner.Buffer(make([]byte, 4096), MaxClientLineSize)
+	for scanner.Scan() {
+		messageTransport, err := DecodeClientMessage(scanner.Bytes())
+		if err != nil {
+			sconn.errors++
+			log.Printf("Bad message from %s (%d so far): %v", sconn.Conn.RemoteAddr(), sconn.errors, err)
+			if sconn.errors >= ConnErrorBudget {
+				sconn.writeError("Too many malformed messages")
+				return
+			}
+			sconn.Send(MessageError{Message: err.Error()})
+			continue
+		}
+		if messageTransport.MsgType == TypeMessagePong { // Nobody else cares about pongs
+			var pong MessagePong
+			messageTransport.Decode(&pong)
+			sconn.handlePong(pong)
+			continue
+		}
+		in <- messageTransport
+	}
+	if err := scanner.Err(); err == bufio.ErrTooLong {
+		log.Printf("Message from %s is longer than %d bytes", sconn.Conn.RemoteAddr(), MaxClientLineSize)
+		sconn.writeError("Message too long")
+	}
+	log.Printf("Connection closed: %s", sconn.Conn.RemoteAddr())
+}
+
+// writeError is the last word to a client that is about to be disconnected. It doesn't
+// wait for the queued messages, the connection is closed right after
+func (sconn *ServerConn) writeError(message string) {
+	sconn.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	sconn.Conn.Write(EncodeLine(MessageError{Message: message}))
+}
+
+// HandleWrite sends the messages to the client until the connection is closed
+func (sconn *ServerConn) HandleWrite() {
+	for {
+		select {
+		case message := <-sconn.Out:
+			sconn.Conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+			if _, err := sconn.Conn.Write(EncodeLine(message)); err != nil {
+				log.Printf("Failed to write: %v Error: %v", message, err)
+				sconn.Conn.Close() // HandleRead lets the client go
+				return
+			}
+		case <-sconn.closed:
+			return
+		}
+	}
+}
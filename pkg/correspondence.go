@@ -0,0 +1,556 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/notnil/chess"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CorrespondenceFile          = "correspondence.json"
+	CorrespondenceSweepInterval = time.Minute
+	CorrespondenceDefaultDays   = 3
+	CorrespondenceMaxDays       = 14
+)
+
+var (
+	ErrCorrespondenceNotFound = errors.New("game not found")
+	ErrCorrespondenceNotYours = errors.New("you don't play this game")
+	ErrCorrespondenceTurn     = errors.New("it's not your move")
+	ErrCorrespondenceMove     = errors.New("illegal move")
+	ErrCorrespondenceAccount  = errors.New("correspondence games need an ssh key, log in with one")
+	ErrCorrespondenceSelf     = errors.New("you can't play against yourself")
+	ErrCorrespondenceDays     = fmt.Errorf("days per move must be between 1 and %d", CorrespondenceMaxDays)
+	ErrCorrespondencePending  = errors.New("the challenge hasn't been accepted yet")
+	ErrCorrespondenceAsked    = errors.New("a challenge with this player is waiting for an answer")
+	ErrCorrespondenceAnswer   = errors.New("no challenge of yours to answer")
+)
+
+// A game where each side has days to move. It lives on disk, not in a goroutine:
+// a move is a short request and the deadlines are checked by a single sweeper.
+// It starts as a challenge, the game begins once the opponent accepts it
+type CorrespondenceGame struct {
+	Id          string
+	White       string // account fingerprints
+	Black       string
+	WhiteName   string
+	BlackName   string
+	DaysPerMove int
+	Challenger  string    // fingerprint of who asked for the game, empty once it's accepted
+	Moves       []string  // UCI notation
+	Deadline    time.Time // of the player to move, or to answer the challenge
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+func (g *CorrespondenceGame) copy() *CorrespondenceGame {
+	cp := *g
+	cp.Moves = append([]string(nil), g.Moves...)
+	return &cp
+}
+
+func (g *CorrespondenceGame) Turn() PlayerRole {
+	if len(g.Moves)%2 == 0 {
+		return White
+	}
+	return Black
+}
+
+// Role of the account in the game, Viewer if it doesn't play
+func (g *CorrespondenceGame) Role(fingerprint string) PlayerRole {
+	switch fingerprint {
+	case g.White:
+		return White
+	case g.Black:
+		return Black
+	default:
+		return Viewer
+	}
+}
+
+func (g *CorrespondenceGame) Opponent(fingerprint string) string {
+	if fingerprint == g.White {
+		return g.BlackName
+	}
+	return g.WhiteName
+}
+
+func (g *CorrespondenceGame) IsTurn(fingerprint string) bool {
+	return !g.Pending() && g.Role(fingerprint) == g.Turn()
+}
+
+// Pending is true while the opponent hasn't accepted the challenge
+func (g *CorrespondenceGame) Pending() bool {
+	return g.Challenger != ""
+}
+
+// In PGN, days per move are one move per that many seconds
+func (g *CorrespondenceGame) TimeControl() TimeControl {
+	return TimeControl{Periods: []Period{{Moves: 1, Duration: time.Duration(g.DaysPerMove) * 24 * time.Hour}}}
+}
+
+func (g *CorrespondenceGame) Speed() Speed {
+	return SpeedCorrespondence
+}
+
+type Correspondence struct {
+	Path   string
+	Server *Server
+	mu     sync.Mutex
+	games  map[string]*CorrespondenceGame // games being played, finished ones go to the archive
+}
+
+func NewCorrespondence(server *Server, path string) (*Correspondence, error) {
+	c := &Correspondence{
+		Path:   path,
+		Server: server,
+		games:  make(map[string]*CorrespondenceGame),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var list []*CorrespondenceGame
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	for _, g := range list {
+		c.games[g.Id] = g
+	}
+	return c, nil
+}
+
+// Caller must hold the lock
+func (c *Correspondence) save() error {
+	list := make([]*CorrespondenceGame, 0, len(c.games))
+	for _, g := range c.games {
+		list = append(list, g)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := c.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.Path)
+}
+
+// Create challenges b to a game with random colors, it starts once b accepts.
+// There's one challenge at a time between the same players
+func (c *Correspondence) Create(a, b *Account, days int) (*CorrespondenceGame, error) {
+	if days < 1 || days > CorrespondenceMaxDays {
+		return nil, ErrCorrespondenceDays
+	}
+	if a.Fingerprint == b.Fingerprint {
+		return nil, ErrCorrespondenceSelf
+	}
+	challenger := a.Fingerprint
+	if rand.Intn(2) == 0 {
+		a, b = b, a
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, g := range c.games {
+		if g.Pending() && g.Role(a.Fingerprint) != Viewer && g.Role(b.Fingerprint) != Viewer {
+			return nil, ErrCorrespondenceAsked
+		}
+	}
+
+	id := NewToken()[:8]
+	for _, ok := c.games[id]; ok; _, ok = c.games[id] {
+		id = NewToken()[:8]
+	}
+	now := time.Now()
+	g := &CorrespondenceGame{
+		Id:          id,
+		White:       a.Fingerprint,
+		Black:       b.Fingerprint,
+		WhiteName:   a.Name,
+		BlackName:   b.Name,
+		DaysPerMove: days,
+		Challenger:  challenger,
+		Deadline:    now.Add(time.Duration(days) * 24 * time.Hour),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	c.games[id] = g
+	log.Printf("Created correspondence challenge %s: %s vs %s", id, g.WhiteName, g.BlackName)
+	return g.copy(), c.save()
+}
+
+// Accept starts the game the account was challenged to, white has the days per move from now on
+func (c *Correspondence) Accept(id, fingerprint string) (*CorrespondenceGame, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	g, ok := c.games[id]
+	if !ok {
+		return nil, ErrCorrespondenceNotFound
+	}
+	if !g.Pending() || g.Challenger == fingerprint || g.Role(fingerprint) == Viewer {
+		return nil, ErrCorrespondenceAnswer
+	}
+	now := time.Now()
+	g.Challenger = ""
+	g.CreatedAt = now
+	g.UpdatedAt = now
+	g.Deadline = now.Add(time.Duration(g.DaysPerMove) * 24 * time.Hour)
+	log.Printf("Correspondence game %s accepted", id)
+	return g.copy(), c.save()
+}
+
+// Decline turns the challenge down, or withdraws it when it's the challenger's. Nothing is archived
+func (c *Correspondence) Decline(id, fingerprint string) (*CorrespondenceGame, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	g, ok := c.games[id]
+	if !ok {
+		return nil, ErrCorrespondenceNotFound
+	}
+	if !g.Pending() || g.Role(fingerprint) == Viewer {
+		return nil, ErrCorrespondenceAnswer
+	}
+	delete(c.games, id)
+	log.Printf("Correspondence challenge %s declined", id)
+	return g.copy(), c.save()
+}
+
+func (c *Correspondence) Get(id string) (*CorrespondenceGame, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, ok := c.games[id]
+	if !ok {
+		return nil, ErrCorrespondenceNotFound
+	}
+	return g.copy(), nil
+}
+
+// Move plays a move in UCI or algebraic notation. When the move ends the game, the outcome is returned
+func (c *Correspondence) Move(id, fingerprint, moveStr string) (*CorrespondenceGame, chess.Outcome, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	g, ok := c.games[id]
+	if !ok {
+		return nil, chess.NoOutcome, ErrCorrespondenceNotFound
+	}
+	if g.Role(fingerprint) == Viewer {
+		return nil, chess.NoOutcome, ErrCorrespondenceNotYours
+	}
+	if g.Pending() {
+		return nil, chess.NoOutcome, ErrCorrespondencePending
+	}
+	if !g.IsTurn(fingerprint) {
+		return nil, chess.NoOutcome, ErrCorrespondenceTurn
+	}
+	game, err := GameFromMoves(g.Moves)
+	if err != nil {
+		return nil, chess.NoOutcome, err
+	}
+	move, err := ParseMove(game.Position(), moveStr)
+	if err != nil || game.Move(move) != nil {
+		return nil, chess.NoOutcome, ErrCorrespondenceMove
+	}
+
+	now := time.Now()
+	g.Moves = append(g.Moves, chess.UCINotation{}.Encode(nil, move))
+	g.Deadline = now.Add(time.Duration(g.DaysPerMove) * 24 * time.Hour)
+	g.UpdatedAt = now
+	if game.Outcome() != chess.NoOutcome {
+		c.end(g, game.Outcome(), game.Method().String())
+		return g.copy(), game.Outcome(), nil
+	}
+	return g.copy(), chess.NoOutcome, c.save()
+}
+
+func (c *Correspondence) Resign(id, fingerprint string) (*CorrespondenceGame, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	g, ok := c.games[id]
+	if !ok {
+		return nil, ErrCorrespondenceNotFound
+	}
+	if g.Pending() {
+		return nil, ErrCorrespondencePending
+	}
+	switch g.Role(fingerprint) {
+	case White:
+		c.end(g, chess.BlackWon, "Resignation")
+	case Black:
+		c.end(g, chess.WhiteWon, "Resignation")
+	default:
+		return nil, ErrCorrespondenceNotYours
+	}
+	return g.copy(), nil
+}
+
+// Inbox lists the games of the account, the ones waiting for its move first
+func (c *Correspondence) Inbox(fingerprint string) []*CorrespondenceGame {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var inbox []*CorrespondenceGame
+	for _, g := range c.games {
+		if g.Role(fingerprint) != Viewer {
+			inbox = append(inbox, g.copy())
+		}
+	}
+	sort.Slice(inbox, func(i, j int) bool {
+		if inbox[i].IsTurn(fingerprint) != inbox[j].IsTurn(fingerprint) {
+			return inbox[i].IsTurn(fingerprint)
+		}
+		return inbox[i].Deadline.Before(inbox[j].Deadline)
+	})
+	return inbox
+}
+
+// Run forfeits the games whose deadline has passed, one goroutine for all the games
+func (c *Correspondence) Run() {
+	tick := time.NewTicker(CorrespondenceSweepInterval)
+	for {
+		select {
+		case now := <-tick.C:
+			c.Sweep(now)
+		}
+	}
+}
+
+func (c *Correspondence) Sweep(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expired := false
+	for _, g := range c.games {
+		if now.Before(g.Deadline) {
+			continue
+		}
+		if g.Pending() { // Nobody answered, there's no game to archive
+			delete(c.games, g.Id)
+			expired = true
+			log.Printf("Correspondence challenge %s expired", g.Id)
+			continue
+		}
+		if g.Turn() == White {
+			c.end(g, chess.BlackWon, "Time Out")
+		} else {
+			c.end(g, chess.WhiteWon, "Time Out")
+		}
+	}
+	if expired {
+		if err := c.save(); err != nil {
+			log.Printf("Failed to save correspondence games: %v", err)
+		}
+	}
+}
+
+// end archives the game and rates it. Caller must hold the lock
+func (c *Correspondence) end(g *CorrespondenceGame, outcome chess.Outcome, termination string) {
+	delete(c.games, g.Id)
+	if err := c.save(); err != nil {
+		log.Printf("Failed to save correspondence games: %v", err)
+	}
+	log.Printf("Correspondence game %s ended: %s by %s", g.Id, outcome, termination)
+
+	s := c.Server
+	tc := g.TimeControl()
+	record := &GameRecord{
+		Match:       "correspondence-" + g.Id,
+		White:       strings.Title(g.WhiteName),
+		Black:       strings.Title(g.BlackName),
+		Duration:    tc.Periods[0].Duration,
+		Control:     tc.String(),
+		Result:      outcome,
+		Termination: termination,
+		Moves:       g.Moves,
+		StartedAt:   g.CreatedAt,
+		EndedAt:     time.Now(),
+	}
+	if err := s.Archive.Save(record); err != nil {
+		log.Printf("Failed to archive correspondence game %s: %v", g.Id, err)
+	} else {
+		for _, fingerprint := range []string{g.White, g.Black} {
+			if err := s.Accounts.AddGame(fingerprint, record.Id); err != nil {
+				log.Printf("Failed to add game %s to account %s: %v", record.Id, fingerprint, err)
+			}
+		}
+	}
+
+	// Nothing to rate in a game without moves
+	if len(g.Moves) < 2 {
+		return
+	}
+	var whiteScore float64
+	switch outcome {
+	case chess.WhiteWon:
+		whiteScore = 1
+	case chess.Draw:
+		whiteScore = 0.5
+	}
+	if _, _, err := s.Accounts.RecordResult(g.White, g.Black, g.Speed(), whiteScore); err != nil {
+		log.Printf("Failed to rate correspondence game %s: %v", g.Id, err)
+	}
+}
+
+const correspondenceUsage = `Correspondence commands, you need to log in with an ssh key:
+> [green]corr[white] : your games, the ones waiting for your move first
+> [green]corr new (name) (days)[white] : challenge a player, with days per move
+> [green]corr accept (id)[white] : start a game you were challenged to
+> [green]corr decline (id)[white] : turn a challenge down, or withdraw yours
+> [green]corr view (id)[white] : see the board
+> [green]corr move (id) (move)[white] : e.g. e2e4 or Nf3
+> [green]corr resign (id)[white]`
+
+func (s *Server) HandleCorrespondenceCommand(sconn *ServerConn, args []string) {
+	reply := func(text string) {
+		sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{text}})
+	}
+	acc := s.Accounts.Get(sconn.Identity)
+	if acc == nil {
+		reply(ErrCorrespondenceAccount.Error())
+		return
+	}
+
+	if len(args) == 0 || args[0] == "" {
+		inbox := s.Correspondence.Inbox(acc.Fingerprint)
+		if len(inbox) == 0 {
+			reply("No correspondence game yet\n" + correspondenceUsage)
+			return
+		}
+		text := "Correspondence games:\n"
+		for _, g := range inbox {
+			if g.Pending() {
+				if g.Challenger == acc.Fingerprint {
+					text += fmt.Sprintf("[red]%s[white] challenge to [green]%s[white], %d days per move, waiting for the answer\n", g.Id, strings.Title(g.Opponent(acc.Fingerprint)), g.DaysPerMove)
+				} else {
+					text += fmt.Sprintf("[red]%s[white] challenge from [green]%s[white], %d days per move: [green]corr accept %s[white] or [green]corr decline %s[white]\n", g.Id, strings.Title(g.Opponent(acc.Fingerprint)), g.DaysPerMove, g.Id, g.Id)
+				}
+				continue
+			}
+			status := "their move"
+			if g.IsTurn(acc.Fingerprint) {
+				status = "[red]your move[white]"
+			}
+			text += fmt.Sprintf("[red]%s[white] vs [green]%s[white] as %s, move %d, %s, %s left\n", g.Id, strings.Title(g.Opponent(acc.Fingerprint)),
+				g.Role(acc.Fingerprint), len(g.Moves)/2+1, status, time.Until(g.Deadline).Round(time.Minute))
+		}
+		reply(text)
+		return
+	}
+	if len(args) < 2 {
+		reply(correspondenceUsage)
+		return
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "new":
+		opponent := s.Accounts.FindByName(args[1])
+		if opponent == nil {
+			reply(fmt.Sprintf("Nobody is called [red]%s[white] here", args[1]))
+			return
+		}
+		days := CorrespondenceDefaultDays
+		if len(args) > 2 {
+			days, _ = strconv.Atoi(args[2])
+		}
+		g, err := s.Correspondence.Create(acc, opponent, days)
+		if err != nil {
+			reply(fmt.Sprintf("Can't challenge [green]%s[white]: %s", strings.Title(opponent.Name), err))
+			return
+		}
+		reply(fmt.Sprintf("Challenged [green]%s[white] to correspondence game [red]%s[white], you'll play %s with %d days per move once it's accepted", strings.Title(opponent.Name), g.Id, g.Role(acc.Fingerprint), days))
+
+	case "accept":
+		g, err := s.Correspondence.Accept(args[1], acc.Fingerprint)
+		if err != nil {
+			reply(fmt.Sprintf("Can't accept [red]%s[white]: %s", args[1], err))
+			return
+		}
+		reply(fmt.Sprintf("Started correspondence game [red]%s[white] against [green]%s[white], you play %s with %d days per move", g.Id, strings.Title(g.Opponent(acc.Fingerprint)), g.Role(acc.Fingerprint), g.DaysPerMove))
+
+	case "decline":
+		g, err := s.Correspondence.Decline(args[1], acc.Fingerprint)
+		if err != nil {
+			reply(fmt.Sprintf("Can't decline [red]%s[white]: %s", args[1], err))
+			return
+		}
+		reply(fmt.Sprintf("Challenge [red]%s[white] with [green]%s[white] is off", g.Id, strings.Title(g.Opponent(acc.Fingerprint))))
+
+	case "view":
+		g, err := s.Correspondence.Get(args[1])
+		if err != nil {
+			reply(fmt.Sprintf("Can't view [red]%s[white]: %s", args[1], err))
+			return
+		}
+		game, err := GameFromMoves(g.Moves)
+		if err != nil {
+			log.Printf("Correspondence game %s is damaged: %v", g.Id, err)
+		}
+		turn := fmt.Sprintf("%s to move before %s", g.Turn(), g.Deadline.Format("Jan 2 15:04 MST"))
+		if g.Pending() {
+			turn = fmt.Sprintf("Challenge to answer before %s", g.Deadline.Format("Jan 2 15:04 MST"))
+		}
+		view := MessageArchivedGame{
+			Id:          g.Id,
+			White:       strings.Title(g.WhiteName),
+			Black:       strings.Title(g.BlackName),
+			Result:      chess.NoOutcome.String(),
+			Termination: turn,
+			Moves:       g.Moves,
+			PGN:         fmt.Sprintf("Correspondence game %s, %d days per move\n%s\n\n%s\nMove with [green]corr move %s (move)[white] in the menu", g.Id, g.DaysPerMove, turn, game.String(), g.Id),
+		}
+		// The clock of the player to move shows the time left before the deadline
+		if !g.Pending() {
+			if g.Turn() == White {
+				view.WhiteClock = time.Until(g.Deadline)
+			} else {
+				view.BlackClock = time.Until(g.Deadline)
+			}
+		}
+		sconn.Send(view)
+
+	case "move":
+		if len(args) < 3 {
+			reply(correspondenceUsage)
+			return
+		}
+		g, outcome, err := s.Correspondence.Move(args[1], acc.Fingerprint, args[2])
+		if err != nil {
+			reply(fmt.Sprintf("Can't move in [red]%s[white]: %s", args[1], err))
+			return
+		}
+		if outcome != chess.NoOutcome {
+			reply(fmt.Sprintf("Game [red]%s[white] is over: %s", g.Id, outcome))
+			return
+		}
+		reply(fmt.Sprintf("Played %s in [red]%s[white], waiting for [green]%s[white]", args[2], g.Id, strings.Title(g.Opponent(acc.Fingerprint))))
+
+	case "resign":
+		g, err := s.Correspondence.Resign(args[1], acc.Fingerprint)
+		if err != nil {
+			reply(fmt.Sprintf("Can't resign [red]%s[white]: %s", args[1], err))
+			return
+		}
+		reply(fmt.Sprintf("You resigned game [red]%s[white]", g.Id))
+
+	default:
+		reply(correspondenceUsage)
+	}
+}
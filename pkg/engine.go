@@ -0,0 +1,473 @@
+package pkg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/notnil/chess"
+	"github.com/notnil/chess/uci"
+	"io"
+	"log"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	EngineBinary       = "stockfish"
+	EnginePoolSize     = 2
+	EngineQueueTimeout = 5 * time.Second // how long a search waits for a free engine
+	EngineStartTimeout = 5 * time.Second
+	EngineSearchSlack  = 2 * time.Second // an engine later than its move time by this much is considered dead
+	HintMoveTime       = time.Second
+	PracticeEloMin     = 400 // a smaller practice number is a level
+	PracticeEloMax     = 3000
+
+	ErrEngineBusy    = errors.New("all engines are busy")
+	ErrEngineCrashed = errors.New("engine stopped responding")
+	ErrEngineClosed  = errors.New("engines are shut down")
+	ErrNoMove        = errors.New("no legal move")
+)
+
+// Searcher is a chess engine that plays one game at a time. The pool hands them out to the matches
+type Searcher interface {
+	Name() string
+	// NewGame forgets what the engine knows about the previous game
+	NewGame() error
+	Search(position *chess.Position, limits SearchLimits) (uci.SearchResults, error)
+	Close() error
+}
+
+// How long and how well an engine searches
+type SearchLimits struct {
+	MoveTime time.Duration
+	Level    int // practice level from 1 to 5, 0 for full strength
+	Elo      int // target rating, it takes over the level when set
+	// Clocks of a timed game, the engine shares its own time between the moves when they are set
+	WhiteTime      time.Duration
+	BlackTime      time.Duration
+	WhiteIncrement time.Duration
+	BlackIncrement time.Duration
+	MovesToGo      int
+}
+
+// Practice levels as Stockfish's Skill Level, with the rating they roughly play at
+var PracticeLevels = []struct{ Skill, Elo int }{
+	{Skill: 20, Elo: 3000}, // full strength
+	{Skill: 0, Elo: 800},
+	{Skill: 3, Elo: 1100},
+	{Skill: 6, Elo: 1400},
+	{Skill: 10, Elo: 1700},
+	{Skill: 15, Elo: 2000},
+}
+
+// PracticeLimits is the search of a practice level, the higher the level the longer the compute
+func PracticeLimits(level int) SearchLimits {
+	if level < 1 {
+		level = 1
+	} else if level >= len(PracticeLevels) {
+		level = len(PracticeLevels) - 1
+	}
+	return SearchLimits{MoveTime: time.Second / time.Duration(200/math.Pow(float64(level), 2.)), Level: level}
+}
+
+// level is the practice level, the one closest to the target rating when there is one
+func (l SearchLimits) level() int {
+	if l.Elo == 0 {
+		return l.Level
+	}
+	closest := 1
+	for level := 1; level < len(PracticeLevels); level++ {
+		if abs(PracticeLevels[level].Elo-l.Elo) < abs(PracticeLevels[closest].Elo-l.Elo) {
+			closest = level
+		}
+	}
+	return closest
+}
+
+func (l SearchLimits) timed() bool {
+	return l.WhiteTime > 0 || l.BlackTime > 0
+}
+
+// budget is the time to spend on a move, the fixed move time or a share of the clock of the side to move
+func (l SearchLimits) budget(turn chess.Color) time.Duration {
+	if !l.timed() {
+		return l.MoveTime
+	}
+	left, increment := l.WhiteTime, l.WhiteIncrement
+	if turn == chess.Black {
+		left, increment = l.BlackTime, l.BlackIncrement
+	}
+	moves := 30
+	if l.MovesToGo > 0 && l.MovesToGo < moves {
+		moves = l.MovesToGo + 1
+	}
+	budget := left/time.Duration(moves) + increment/2
+	if budget > left/2 {
+		budget = left / 2
+	}
+	return budget
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// An engine process speaking UCI. Unlike uci.Engine, a search can't block forever:
+// the output is read by its own goroutine and every wait has a deadline
+type UCIEngine struct {
+	Binary  string
+	name    string
+	options map[string][2]int // min and max of the spin options
+	cmd     *exec.Cmd
+	in      io.WriteCloser
+	lines   chan string // closed when the process exits
+}
+
+func NewUCIEngine(binary string) (*UCIEngine, error) {
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(path)
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	e := &UCIEngine{Binary: binary, cmd: cmd, in: in, lines: make(chan string)}
+	go e.read(out)
+
+	if err := e.send(uci.CmdUCI.Name); err != nil {
+		e.Close()
+		return nil, err
+	}
+	lines, err := e.waitFor("uciok", EngineStartTimeout)
+	if err != nil {
+		e.Close()
+		return nil, err
+	}
+	e.name = binary
+	e.options = make(map[string][2]int)
+	for _, line := range lines {
+		if strings.HasPrefix(line, "id name ") {
+			e.name = strings.TrimPrefix(line, "id name ")
+		} else if name, min, max, ok := parseSpinOption(line); ok {
+			e.options[name] = [2]int{min, max}
+		}
+	}
+	return e, nil
+}
+
+// parseSpinOption reads lines like: option name Skill Level type spin default 20 min 0 max 20.
+// uci.Option can't, it only keeps the first word of the name
+func parseSpinOption(line string) (name string, min, max int, ok bool) {
+	if !strings.HasPrefix(line, "option name ") || !strings.Contains(line, " type spin ") {
+		return "", 0, 0, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(line, "option name "), " type spin ", 2)
+	fields := strings.Fields(parts[1])
+	for i := 0; i+1 < len(fields); i += 2 {
+		switch fields[i] {
+		case "min":
+			min, _ = strconv.Atoi(fields[i+1])
+		case "max":
+			max, _ = strconv.Atoi(fields[i+1])
+		}
+	}
+	return parts[0], min, max, true
+}
+
+// strength is how the engine is told to play weaker: at a rating when it can, with a skill level otherwise
+func (e *UCIEngine) strength(limits SearchLimits) []uci.CmdSetOption {
+	var options []uci.CmdSetOption
+	if elo, ok := e.options["UCI_Elo"]; ok && limits.Elo >= elo[0] {
+		if limits.Elo > elo[1] {
+			limits.Elo = elo[1]
+		}
+		return append(options,
+			uci.CmdSetOption{Name: "UCI_LimitStrength", Value: "true"},
+			uci.CmdSetOption{Name: "UCI_Elo", Value: strconv.Itoa(limits.Elo)})
+	}
+	if _, ok := e.options["UCI_Elo"]; ok {
+		options = append(options, uci.CmdSetOption{Name: "UCI_LimitStrength", Value: "false"})
+	}
+	if _, ok := e.options["Skill Level"]; ok {
+		options = append(options, uci.CmdSetOption{Name: "Skill Level", Value: strconv.Itoa(PracticeLevels[limits.level()].Skill)})
+	}
+	return options
+}
+
+func (e *UCIEngine) Name() string {
+	return e.name
+}
+
+func (e *UCIEngine) read(out io.Reader) {
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		e.lines <- scanner.Text()
+	}
+	close(e.lines)
+	e.cmd.Wait()
+}
+
+func (e *UCIEngine) send(line string) error {
+	_, err := fmt.Fprintln(e.in, line)
+	return err
+}
+
+// waitFor returns the lines the engine writes up to the one starting with prefix
+func (e *UCIEngine) waitFor(prefix string, timeout time.Duration) ([]string, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	var lines []string
+	for {
+		select {
+		case line, ok := <-e.lines:
+			if !ok {
+				return lines, ErrEngineCrashed
+			}
+			if strings.HasPrefix(line, prefix) {
+				return append(lines, line), nil
+			}
+			lines = append(lines, line)
+		case <-deadline.C:
+			return lines, ErrEngineCrashed
+		}
+	}
+}
+
+func (e *UCIEngine) NewGame() error {
+	if err := e.send(uci.CmdUCINewGame.Name); err != nil {
+		return err
+	}
+	if err := e.send(uci.CmdIsReady.Name); err != nil {
+		return err
+	}
+	_, err := e.waitFor("readyok", EngineStartTimeout)
+	return err
+}
+
+func (e *UCIEngine) Search(position *chess.Position, limits SearchLimits) (uci.SearchResults, error) {
+	var results uci.SearchResults
+	for _, option := range e.strength(limits) {
+		if err := e.send(option.String()); err != nil {
+			return results, err
+		}
+	}
+	cmd := uci.CmdGo{MoveTime: limits.MoveTime}
+	timeout := limits.MoveTime
+	if limits.timed() {
+		cmd = uci.CmdGo{
+			WhiteTime:      limits.WhiteTime,
+			BlackTime:      limits.BlackTime,
+			WhiteIncrement: limits.WhiteIncrement,
+			BlackIncrement: limits.BlackIncrement,
+			MovesToGo:      limits.MovesToGo,
+		}
+		// The engine may use all its time
+		timeout = limits.WhiteTime
+		if position.Turn() == chess.Black {
+			timeout = limits.BlackTime
+		}
+	}
+	if err := e.send(uci.CmdPosition{Position: position}.String()); err != nil {
+		return results, err
+	}
+	if err := e.send(cmd.String()); err != nil {
+		return results, err
+	}
+	lines, err := e.waitFor("bestmove", timeout+EngineSearchSlack)
+	if err != nil {
+		return results, err
+	}
+
+	for _, line := range lines[:len(lines)-1] {
+		var info uci.Info
+		if err := info.UnmarshalText([]byte(line)); err == nil {
+			results.Info = info
+		}
+	}
+	parts := strings.Fields(lines[len(lines)-1])
+	if len(parts) < 2 {
+		return results, fmt.Errorf("no best move in %q", lines[len(lines)-1])
+	}
+	if parts[1] == "(none)" { // Mate or stalemate, the engine is fine
+		return results, ErrNoMove
+	}
+	results.BestMove, err = chess.UCINotation{}.Decode(position, parts[1])
+	return results, err
+}
+
+func (e *UCIEngine) Close() error {
+	e.send(uci.CmdQuit.Name)
+	e.in.Close()
+	// Whatever is left to read goes away with the process
+	go func() {
+		for range e.lines {
+		}
+	}()
+	return e.cmd.Process.Kill()
+}
+
+// A fixed number of engines shared by the practice games. A search checks an engine out and
+// waits in line when they are all busy. An engine that fails is dropped, a new one takes its
+// place at the next search
+type EnginePool struct {
+	Name    string
+	New     func() (Searcher, error) // starts an engine
+	Timeout time.Duration
+	size    int
+	engines chan Searcher // idle
+	mu      sync.Mutex
+	busy    map[Searcher]bool // checked out by a search, Close kills them too
+	count   int               // engines running, idle or busy
+	closed  bool
+}
+
+func NewEnginePool(newEngine func() (Searcher, error), size int, timeout time.Duration) (*EnginePool, error) {
+	if size < 1 {
+		size = 1
+	}
+	pool := &EnginePool{
+		New:     newEngine,
+		Timeout: timeout,
+		size:    size,
+		engines: make(chan Searcher, size),
+		busy:    make(map[Searcher]bool),
+	}
+	for i := 0; i < size; i++ {
+		eng, err := newEngine()
+		if err != nil {
+			pool.Close()
+			return nil, err
+		}
+		pool.count++
+		pool.engines <- eng
+		pool.Name = eng.Name()
+	}
+	return pool, nil
+}
+
+// NewUCIEnginePool runs size processes of the UCI engine binary
+func NewUCIEnginePool(binary string, size int, timeout time.Duration) (*EnginePool, error) {
+	return NewEnginePool(func() (Searcher, error) {
+		return NewUCIEngine(binary)
+	}, size, timeout)
+}
+
+// Search runs a search on a fresh game with the first engine available
+func (p *EnginePool) Search(position *chess.Position, limits SearchLimits) (uci.SearchResults, error) {
+	eng, err := p.checkout()
+	if err != nil {
+		return uci.SearchResults{}, err
+	}
+
+	err = eng.NewGame()
+	var results uci.SearchResults
+	if err == nil {
+		results, err = eng.Search(position, limits)
+	}
+	failed := err != nil && err != ErrNoMove
+	if failed {
+		log.Printf("Dropping engine after: %v", err)
+	}
+	p.checkin(eng, failed)
+	return results, err
+}
+
+// checkout takes an idle engine, starts one in the place of a dropped one, or waits in line
+func (p *EnginePool) checkout() (Searcher, error) {
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		return nil, ErrEngineClosed
+	}
+	var eng Searcher
+	select {
+	case eng = <-p.engines:
+	default:
+		if eng = p.start(); eng == nil {
+			select {
+			case eng = <-p.engines:
+			case <-time.After(p.Timeout):
+				return nil, ErrEngineBusy
+			}
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		p.count--
+		eng.Close()
+		return nil, ErrEngineClosed
+	}
+	p.busy[eng] = true
+	return eng, nil
+}
+
+// start runs a new engine if fewer than size are running. Nil when it can't
+func (p *EnginePool) start() Searcher {
+	p.mu.Lock()
+	if p.closed || p.count >= p.size {
+		p.mu.Unlock()
+		return nil
+	}
+	p.count++ // The slot is taken while the engine starts
+	p.mu.Unlock()
+
+	eng, err := p.New()
+	if err != nil {
+		log.Printf("Failed to start engine: %v", err)
+		p.mu.Lock()
+		p.count--
+		p.mu.Unlock()
+		return nil
+	}
+	return eng
+}
+
+// checkin puts the engine back in line, or drops it when it failed
+func (p *EnginePool) checkin(eng Searcher, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.busy, eng)
+	if failed || p.closed {
+		p.count--
+		eng.Close()
+		return
+	}
+	p.engines <- eng // There's room for every engine running
+}
+
+// Close stops the idle engines and the ones in the middle of a search, those searches fail
+func (p *EnginePool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for eng := range p.busy {
+		eng.Close()
+	}
+	for {
+		select {
+		case eng := <-p.engines:
+			p.count--
+			eng.Close()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	"github.com/notnil/chess"
+	"io"
+	"math"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var WatchInterval = 500 * time.Millisecond // how often watch looks for new moves
+
+const execUsage = `Commands:
+  ls, games [--json]              matches on the server
+  pgn (match|game id)             PGN of a game in progress or archived
+  leaderboard [speed] [--json]    best rated players
+  watch (match) [--json]          moves of a game as they are played, until it ends
+`
+
+// A match as the scripts see it
+type GameInfo struct {
+	Name        string
+	State       string
+	Control     string
+	Speed       Speed
+	Rated       bool
+	Practice    bool
+	White       string
+	Black       string
+	Viewers     int
+	Moves       []string // UCI notation
+	Fen         string
+	WhiteClock  time.Duration // remaining times
+	BlackClock  time.Duration
+	Result      string // * until the game ends
+	Termination string
+}
+
+// A move of a watched game, or its end when Result is set
+type WatchEvent struct {
+	Match       string
+	Ply         int           `json:",omitempty"`
+	Move        string        `json:",omitempty"` // UCI notation
+	SAN         string        `json:",omitempty"`
+	Fen         string        `json:",omitempty"` // after the move
+	Clock       time.Duration `json:",omitempty"` // left to the side that moved
+	Result      string        `json:",omitempty"`
+	Termination string        `json:",omitempty"`
+}
+
+// One line of the leaderboard
+type LeaderboardEntry struct {
+	Speed       Speed
+	Rank        int
+	Name        string
+	Rating      int
+	Provisional bool
+	Games       int
+}
+
+// info runs on the match goroutine
+func (m *Match) info() GameInfo {
+	viewers := 0
+	for _, p := range m.Players {
+		if p.Role == Viewer {
+			viewers++
+		}
+	}
+	return GameInfo{
+		Name:        m.Name,
+		State:       m.State.String(),
+		Control:     m.Control.String(),
+		Speed:       m.Speed(),
+		Rated:       m.Rated,
+		Practice:    m.PracticeMode,
+		White:       m.playerName(White),
+		Black:       m.playerName(Black),
+		Viewers:     viewers,
+		Moves:       m.GameMoves(),
+		Fen:         m.GameFEN(),
+		WhiteClock:  m.Clocks[int(White)].Left(),
+		BlackClock:  m.Clocks[int(Black)].Left(),
+		Result:      m.Outcome.String(),
+		Termination: m.Termination,
+	}
+}
+
+var colorTag = regexp.MustCompile(`\[[a-z]+\]`)
+
+// stripColors turns the text of the TUI into plain text
+func stripColors(text string) string {
+	return colorTag.ReplaceAllString(text, "")
+}
+
+// execCommand answers an ssh command like `ssh gochess.club ls`, for scripts and bots.
+// The output is plain text, or JSON with --json
+func (s *Server) execCommand(sess ssh.Session) {
+	var args []string
+	asJSON := false
+	for _, arg := range sess.Command() {
+		if arg == "--json" {
+			asJSON = true
+		} else {
+			args = append(args, arg)
+		}
+	}
+	if len(args) == 0 {
+		args = []string{"help"}
+	}
+
+	var err error
+	switch strings.ToLower(args[0]) {
+	case "ls", "games":
+		err = s.execGames(sess, asJSON)
+	case "pgn":
+		if len(args) < 2 {
+			err = fmt.Errorf("usage: pgn (match|game id)")
+			break
+		}
+		err = s.execPGN(sess, strings.Join(args[1:], " "))
+	case "leaderboard":
+		err = s.execLeaderboard(sess, args[1:], asJSON)
+	case "watch":
+		if len(args) < 2 {
+			err = fmt.Errorf("usage: watch (match) [--json]")
+			break
+		}
+		err = s.execWatch(sess, strings.Join(args[1:], " "), asJSON)
+	case "help":
+		io.WriteString(sess, execUsage)
+	default:
+		err = fmt.Errorf("unknown command %s\n%s", args[0], strings.TrimSuffix(execUsage, "\n"))
+	}
+	if err != nil {
+		fmt.Fprintln(sess.Stderr(), err)
+		sess.Exit(1)
+		return
+	}
+	sess.Exit(0)
+}
+
+func writeJSON(w io.Writer, o interface{}) error {
+	return json.NewEncoder(w).Encode(o)
+}
+
+func (s *Server) execGames(sess ssh.Session, asJSON bool) error {
+	games := []GameInfo{}
+	for _, m := range s.Matches.Snapshot() {
+		var info GameInfo
+		if m.Do(func() { info = m.info() }) {
+			games = append(games, info)
+		}
+	}
+	if asJSON {
+		return writeJSON(sess, games)
+	}
+	if len(games) == 0 {
+		_, err := io.WriteString(sess, "No match found\n")
+		return err
+	}
+	w := tabwriter.NewWriter(sess, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "MATCH\tSTATE\tCONTROL\tWHITE\tBLACK\tMOVES\tVIEWERS")
+	for _, game := range games {
+		fmt.Fprintf(w, "%s\t%s\t%s %s\t%s\t%s\t%d\t%d\n", game.Name, game.State, game.Control, game.Speed, game.White, game.Black, len(game.Moves), game.Viewers)
+	}
+	return w.Flush()
+}
+
+// execPGN prints the game going on in a match, or a game of the archive
+func (s *Server) execPGN(sess ssh.Session, id string) error {
+	pgn := ""
+	if m, ok := s.Matches.Get(id); ok {
+		m.Do(func() {
+			if m.RecordId != "" { // Over, the archive has its result
+				id = m.RecordId
+			} else if len(m.Game.Moves()) > 0 {
+				pgn = m.record(m.Outcome, m.Termination).PGN()
+			}
+		})
+	}
+	if pgn == "" {
+		record, err := s.Archive.Load(id)
+		if err != nil {
+			return fmt.Errorf("game %s not found", id)
+		}
+		pgn = record.PGN()
+	}
+	_, err := io.WriteString(sess, pgn)
+	return err
+}
+
+func (s *Server) execLeaderboard(sess ssh.Session, args []string, asJSON bool) error {
+	speeds := Speeds
+	if len(args) > 0 {
+		speed, ok := ParseSpeed(args[0])
+		if !ok {
+			return fmt.Errorf("unknown speed %s, try one of: bullet, blitz, rapid, classical", args[0])
+		}
+		speeds = []Speed{speed}
+	}
+	if !asJSON {
+		_, err := io.WriteString(sess, stripColors(s.LeaderboardString(speeds)))
+		return err
+	}
+	entries := []LeaderboardEntry{}
+	for _, speed := range speeds {
+		for i, acc := range s.Accounts.Leaderboard(speed, LeaderboardLimit) {
+			rating := acc.Rating(speed)
+			entries = append(entries, LeaderboardEntry{
+				Speed:       speed,
+				Rank:        i + 1,
+				Name:        acc.Name,
+				Rating:      int(math.Round(rating.Rating)),
+				Provisional: rating.Provisional(),
+				Games:       rating.Games,
+			})
+		}
+	}
+	return writeJSON(sess, entries)
+}
+
+// execWatch follows a match and prints its moves until the game ends or the session is closed
+func (s *Server) execWatch(sess ssh.Session, name string, asJSON bool) error {
+	m, ok := s.Matches.Get(name)
+	if !ok {
+		return fmt.Errorf("match %s not found", name)
+	}
+	write := func(event WatchEvent) error {
+		if asJSON {
+			return writeJSON(sess, event)
+		}
+		var err error
+		switch {
+		case event.Result != "":
+			_, err = fmt.Fprintf(sess, "%s %s\n", event.Result, event.Termination)
+		case event.Ply%2 == 1:
+			_, err = fmt.Fprintf(sess, "%d. %s (%s)\n", (event.Ply+1)/2, event.SAN, formatClock(event.Clock))
+		default:
+			_, err = fmt.Fprintf(sess, "%d... %s (%s)\n", event.Ply/2, event.SAN, formatClock(event.Clock))
+		}
+		return err
+	}
+
+	tick := time.NewTicker(WatchInterval)
+	defer tick.Stop()
+	seen := 0
+	for first := true; ; first = false {
+		var events []WatchEvent
+		var info GameInfo
+		open := m.Do(func() {
+			info = m.info()
+			moves, positions := m.Game.Moves(), m.Game.Positions()
+			for ; seen < len(moves); seen++ {
+				event := WatchEvent{
+					Match: m.Name,
+					Ply:   seen + 1,
+					Move:  moves[seen].String(),
+					SAN:   chess.AlgebraicNotation{}.Encode(positions[seen], moves[seen]),
+					Fen:   positions[seen+1].String(),
+				}
+				if seen < len(m.MoveClocks) {
+					event.Clock = m.MoveClocks[seen]
+				}
+				events = append(events, event)
+			}
+			if m.Over() {
+				events = append(events, WatchEvent{Match: m.Name, Result: m.Outcome.String(), Termination: m.Termination})
+			}
+		})
+		if !open {
+			if !asJSON {
+				io.WriteString(sess, "The match is closed\n")
+			}
+			return nil
+		}
+		if first && !asJSON {
+			fmt.Fprintf(sess, "Match %s: %s vs %s, %s %s\n", info.Name, info.White, info.Black, info.Control, info.Speed)
+		}
+		for _, event := range events {
+			if err := write(event); err != nil {
+				return nil // Hung up
+			}
+			if event.Result != "" {
+				return nil
+			}
+		}
+
+		select {
+		case <-sess.Context().Done():
+			return nil
+		case <-tick.C:
+		}
+	}
+}
@@ -1,39 +1,104 @@
 package pkg
 
 import (
+	"context"
 	"fmt"
 	"github.com/notnil/chess"
 	"github.com/notnil/chess/uci"
 	"log"
 	"math"
-	"net"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// A match goes through those states, its goroutine stops when it's closed
+type MatchState int
+
+const (
+	MatchWaiting  MatchState = iota // for the first move, no clock runs
+	MatchPlaying                    // the clock of the side to move runs
+	MatchFinished                   // players can still chat, analyze or ask for a new game
+	MatchClosed
+)
+
+func (s MatchState) String() string {
+	switch s {
+	case MatchWaiting:
+		return "Waiting"
+	case MatchPlaying:
+		return "Playing"
+	case MatchFinished:
+		return "Finished"
+	case MatchClosed:
+		return "Closed"
+	default:
+		return "Unknown"
+	}
+}
+
+// A match is owned by its goroutine: messages come in through In, other goroutines go through Do
 type Match struct {
 	//Players [2]*Player
 	Players       map[int]*Player
 	Game          *chess.Game
-	Server        Server
+	Server        *Server
 	Turn          PlayerRole
 	In            chan MessageInterface
 	Out           chan MessageInterface
 	Name          string
 	PracticeMode  bool
-	Engine        *uci.Engine
+	Engines       *EnginePool
 	PracticeLevel int
-	Duration      time.Duration
+	PracticeElo   int                // target rating of the engine, it takes over the level when set
+	EngineRole    PlayerRole         // side the engine plays in practice mode
+	EngineClock   bool               // the engine plays from its clock rather than a fixed time per move
+	Hints         map[PlayerRole]int // hints asked in practice mode, they are kept in the archive
+	RecordId      string             // archive id of the game once it ended
+	Outcome       chess.Outcome      // result of the game once it ended
+	Termination   string
+	Control       TimeControl
+	Duration      time.Duration // of the first period
 	Increment     time.Duration
 	Clocks        map[int]*Clock
+	MoveClocks    []time.Duration // remaining time of the mover after each move
+	StartedAt     time.Time
+	State         MatchState
+	Rated         bool
+	Seats         map[PlayerRole]string // seats reserved for a ServerConn.Key
+	OnEnd         func(m *Match, outcome chess.Outcome)
+	OnAbort       func(m *Match)           // the match is closed before the game has a result
+	AllowBerserk  bool                     // players can halve their clock before their first move
+	Berserked     map[PlayerRole]bool      // players who did
+	Sessions      map[PlayerRole]string    // token of each seat, a player who drops can come back with it
+	Held          map[PlayerRole]*HeldSeat // seats of players who dropped
+	Suspended     bool                     // restored after a restart, the clocks wait for the players to be back
+	DrawOffer     PlayerRole               // side that offered a draw, Viewer when nobody did
+	RematchOffer  PlayerRole               // side that asked for a new game
+	saved         bool                     // snapshot taken at shutdown, the game goes on after the restart
+	viewerCount   int
+	ctx           context.Context
+	cancel        context.CancelFunc
+	calls         chan func()
+	flagTimer     *time.Timer   // fires when the clock of the side to move runs out
+	done          chan struct{} // closed when the goroutine is gone
+}
+
+// A seat kept for a player whose connection dropped, until the timer forfeits the game
+type HeldSeat struct {
+	Player *Player
+	Timer  *time.Timer
 }
 
 func NewGame() *chess.Game {
 	return chess.NewGame(chess.UseNotation(chess.UCINotation{}))
 }
 
-func NewMatch(name string, practiceMode bool, duration, increment int) *Match {
+func NewMatch(server *Server, name string, practiceMode bool, duration, increment int) *Match {
+	return NewMatchWithControl(server, name, practiceMode, NewTimeControl(duration, increment))
+}
+
+func NewMatchWithControl(server *Server, name string, practiceMode bool, tc TimeControl) *Match {
 	game := NewGame()
 	in := make(chan MessageInterface, MessageQueueSize)
 	out := make(chan MessageInterface, MessageQueueSize)
@@ -42,10 +107,15 @@ func NewMatch(name string, practiceMode bool, duration, increment int) *Match {
 
 	// Init clock for each player.
 	// This is indenpdent with player connection since they can disconnect
-	clocks[int(White)] = NewClock(time.Duration(duration)*time.Minute, time.Duration(increment)*time.Second)
-	clocks[int(Black)] = NewClock(time.Duration(duration)*time.Minute, time.Duration(increment)*time.Second)
+	clocks[int(White)] = NewClock(tc)
+	clocks[int(Black)] = NewClock(tc)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	flagTimer := time.NewTimer(time.Hour)
+	flagTimer.Stop()
 
 	match := &Match{
+		Server:        server,
 		Name:          name,
 		In:            in,
 		Out:           out,
@@ -53,60 +123,384 @@ func NewMatch(name string, practiceMode bool, duration, increment int) *Match {
 		Game:          game,
 		Turn:          White, // White move first
 		PracticeMode:  practiceMode,
+		Rated:         !practiceMode,
 		PracticeLevel: 2, // Default level for hardress in single player mode
+		EngineRole:    Black,
 		Clocks:        clocks,
+		Seats:         make(map[PlayerRole]string),
+		Berserked:     make(map[PlayerRole]bool),
+		Sessions:      make(map[PlayerRole]string),
+		Held:          make(map[PlayerRole]*HeldSeat),
+		Hints:         make(map[PlayerRole]int),
+		Outcome:       chess.NoOutcome,
+		DrawOffer:     Viewer,
+		RematchOffer:  Viewer,
+		Control:       tc,
+		Duration:      clocks[int(White)].Duration,
+		Increment:     clocks[int(White)].Increment,
+		StartedAt:     time.Now(),
+		ctx:           ctx,
+		cancel:        cancel,
+		calls:         make(chan func()),
+		flagTimer:     flagTimer,
+		done:          make(chan struct{}),
 	}
 
-	go match.HandleRead()
-	go match.WatchTime()
+	go match.run()
 	return match
 }
 
-func (m *Match) WatchTime() {
-	tick := time.NewTicker(time.Second)
+// run is the goroutine of the match, nothing else touches it
+func (m *Match) run() {
+	defer m.shutdown()
 	for {
 		select {
-		case <-tick.C:
-			var winner PlayerRole
-
-			if m.Clocks[int(White)].Remaining == time.Duration(0) {
-				winner = Black
-			} else if m.Clocks[int(Black)].Remaining == time.Duration(0) {
-				winner = White
-			} else {
-				continue
+		case <-m.ctx.Done():
+			return
+		case message := <-m.In:
+			m.handle(message.(MessageTransport))
+		case f := <-m.calls:
+			if m.ctx.Err() == nil { // Closing, the caller gets false
+				f()
+			}
+		case <-m.flagTimer.C:
+			// The lag of the player is given as a grace, the move might be on its way
+			if !m.Over() && m.Clocks[int(m.Turn)].LeftAt(time.Now().Add(-m.lag(m.Turn))) == 0 {
+				m.flag(m.Turn)
 			}
+		}
+		m.scheduleFlag()
+	}
+}
+
+// scheduleFlag sets the flag timer to when the clock of the side to move runs out
+func (m *Match) scheduleFlag() {
+	if !m.flagTimer.Stop() {
+		select {
+		case <-m.flagTimer.C:
+		default:
+		}
+	}
+	clock := m.Clocks[int(m.Turn)]
+	if m.Over() || clock.Paused {
+		return
+	}
+	m.flagTimer.Reset(clock.Left() + m.lag(m.Turn))
+}
+
+// shutdown releases what the match holds once its goroutine stops
+func (m *Match) shutdown() {
+	// A game saved at shutdown isn't aborted, it goes on after the restart
+	if m.OnAbort != nil && !m.Over() && !m.saved {
+		m.OnAbort(m)
+	}
+	m.flagTimer.Stop()
+	for role, held := range m.Held {
+		held.Timer.Stop()
+		delete(m.Held, role)
+	}
+	m.Clocks[int(White)].Pause()
+	m.Clocks[int(Black)].Pause()
+	for id, p := range m.Players {
+		p.Disconnect()
+		delete(m.Players, id)
+	}
+	m.State = MatchClosed
+	close(m.done)
+	log.Printf("Closed match %s", m.Name)
+}
+
+// Do runs f on the goroutine of the match and waits for it. False when the match is closed
+func (m *Match) Do(f func()) bool {
+	done := make(chan struct{})
+	select {
+	case m.calls <- func() { f(); close(done) }:
+	case <-m.ctx.Done():
+		return false
+	}
+	select {
+	case <-done:
+		return true
+	case <-m.done:
+		select { // f may have closed the match itself
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	}
+}
 
-			// Have a winner
+// post hands a message to the match from another goroutine, it's dropped once the match is closed
+func (m *Match) post(message MessageInterface) {
+	select {
+	case m.In <- Transport(message):
+	case <-m.ctx.Done():
+	}
+}
+
+// Close stops the match and waits for its goroutine to release everything
+func (m *Match) Close() {
+	m.cancel()
+	<-m.done
+}
+
+// CloseIfIdle closes the match when nobody is in it. The seats of dropped players are kept until the game is over
+func (m *Match) CloseIfIdle() bool {
+	idle := true // Already closed
+	m.Do(func() {
+		if idle = len(m.Players) == 0 && (m.Over() || len(m.Held) == 0); idle {
+			m.cancel() // Close would wait for this very goroutine
+		}
+	})
+	if idle {
+		<-m.done
+	}
+	return idle
+}
+
+// ExpectPlayers forfeits the game if it hasn't started after timeout: the side that didn't show up
+// or didn't make the first move loses. The match is closed when neither player came
+func (m *Match) ExpectPlayers(timeout time.Duration) {
+	time.AfterFunc(timeout, func() {
+		m.Do(func() {
+			if m.State != MatchWaiting {
+				return
+			}
+			_, white := m.Players[int(White)]
+			_, black := m.Players[int(Black)]
+			if !white && !black {
+				log.Printf("Nobody showed up in match %s", m.Name)
+				m.cancel()
+				return
+			}
+			loser := White // Didn't come, or came and never moved
+			if white && !black {
+				loser = Black
+			}
+			m.EndGame(m.outcomeAgainst(loser), "No show")
 			for _, p := range m.Players {
-				if p.Role != Viewer {
-					if p.Role == winner {
-						p.Out <- MessageGameAction{Action: ActionWin, Message: "Time Out"}
-					} else {
-						p.Out <- MessageGameAction{Action: ActionLose, Message: "Time Out"}
-					}
+				if p.Role == loser {
+					p.Send(MessageGameAction{Action: ActionLose, Message: "No show"})
 				} else {
-					p.Out <- MessageGameAction{Action: ActionWin, Message: fmt.Sprintf("Time Out. Winner: %s", winner)}
+					p.Send(MessageGameAction{Action: ActionWin, Message: fmt.Sprintf("No show. Winner: %s", loser.Opponent())})
 				}
 			}
-			return
+		})
+	})
+}
+
+// Over is true once the game has a result
+func (m *Match) Over() bool {
+	return m.State >= MatchFinished
+}
+
+func (m *Match) flag(loser PlayerRole) {
+	winner := White
+	if loser == White {
+		winner = Black
+	}
+	m.EndGame(m.outcomeAgainst(loser), "Time Out")
+
+	// Have a winner
+	for _, p := range m.Players {
+		if p.Role != Viewer {
+			if p.Role == winner {
+				p.Send(MessageGameAction{Action: ActionWin, Message: "Time Out"})
+			} else {
+				p.Send(MessageGameAction{Action: ActionLose, Message: "Time Out"})
+			}
+		} else {
+			p.Send(MessageGameAction{Action: ActionWin, Message: fmt.Sprintf("Time Out. Winner: %s", winner)})
 		}
 	}
 }
 
+// Network lag of the player, it isn't charged on the clock
+func (m *Match) lag(role PlayerRole) time.Duration {
+	if p, ok := m.Players[int(role)]; ok {
+		return p.Conn.Lag()
+	}
+	return 0
+}
+
 func (m *Match) ReMatch() {
 	m.Game = NewGame()
 	m.Turn = White
+	m.MoveClocks = nil
+	m.Hints = make(map[PlayerRole]int)
+	m.RecordId = ""
+	m.Outcome = chess.NoOutcome
+	m.Termination = ""
+	m.clearOffers()
+	m.StartedAt = time.Now()
+	m.State = MatchWaiting
 
 	m.Clocks[int(White)].Reset()
 	m.Clocks[int(Black)].Reset()
-	go m.WatchTime()
+}
+
+// offeredTo tells if the offer made by a side is addressed to role
+func offeredTo(offer, role PlayerRole) bool {
+	return offer != Viewer && offer == role.Opponent()
+}
+
+// clearOffers withdraws the draw and rematch offers, a move answers them
+func (m *Match) clearOffers() {
+	m.DrawOffer = Viewer
+	m.RematchOffer = Viewer
+}
+
+// EndGame stops the clocks, archives the game and updates the ratings.
+// It's safe to call more than once, only the first result counts
+func (m *Match) EndGame(outcome chess.Outcome, termination string) {
+	if m.Over() || outcome == chess.NoOutcome {
+		return
+	}
+	m.State = MatchFinished
+	m.Outcome = outcome
+	m.Termination = termination
+	m.clearOffers()
+	m.Clocks[int(White)].Pause()
+	m.Clocks[int(Black)].Pause()
+	if m.OnEnd != nil {
+		m.OnEnd(m, outcome)
+	}
+
+	// Nothing worth keeping in a game without moves
+	if m.Server == nil || len(m.Game.Moves()) == 0 {
+		return
+	}
+	m.archive(outcome, termination)
+	m.updateRatings(outcome)
+}
+
+func (m *Match) archive(outcome chess.Outcome, termination string) {
+	record := m.record(outcome, termination)
+	if err := m.Server.Archive.Save(record); err != nil {
+		log.Printf("Failed to archive match %s: %v", m.Name, err)
+		return
+	}
+	log.Printf("Archived game: %s", record.Id)
+	m.RecordId = record.Id
+
+	// Remember the game in the players' accounts
+	for _, role := range []PlayerRole{White, Black} {
+		if p, ok := m.Players[int(role)]; ok && p.Identity != "" {
+			if err := m.Server.Accounts.AddGame(p.Identity, record.Id); err != nil {
+				log.Printf("Failed to add game %s to account of %s: %v", record.Id, p.Name, err)
+			}
+		}
+	}
+}
+
+// record is the game as it goes in the archive, for the games in progress too
+func (m *Match) record(outcome chess.Outcome, termination string) *GameRecord {
+	return &GameRecord{
+		Match:       m.Name,
+		White:       m.playerName(White),
+		Black:       m.playerName(Black),
+		Duration:    m.Duration,
+		Increment:   m.Increment,
+		Control:     m.Control.String(),
+		Result:      outcome,
+		Termination: termination,
+		Moves:       m.GameMoves(),
+		Clocks:      append([]time.Duration(nil), m.MoveClocks...),
+		WhiteClock:  m.Clocks[int(White)].Remaining,
+		BlackClock:  m.Clocks[int(Black)].Remaining,
+		WhiteHints:  m.Hints[White],
+		BlackHints:  m.Hints[Black],
+		StartedAt:   m.StartedAt,
+		EndedAt:     time.Now(),
+	}
+}
+
+// Only games between two different players logged in with ssh keys are rated
+func (m *Match) updateRatings(outcome chess.Outcome) {
+	white, okWhite := m.Players[int(White)]
+	black, okBlack := m.Players[int(Black)]
+	if !m.Rated || !okWhite || !okBlack || white.Identity == "" || black.Identity == "" || white.Identity == black.Identity {
+		return
+	}
+
+	var whiteScore float64
+	switch outcome {
+	case chess.WhiteWon:
+		whiteScore = 1
+	case chess.Draw:
+		whiteScore = 0.5
+	}
+
+	speed := m.Speed()
+	whiteBefore := m.rating(white)
+	blackBefore := m.rating(black)
+	whiteAfter, blackAfter, err := m.Server.Accounts.RecordResult(white.Identity, black.Identity, speed, whiteScore)
+	if err != nil {
+		log.Printf("Failed to update ratings of match %s: %v", m.Name, err)
+		return
+	}
+
+	message := MessageGameChat{
+		Message: fmt.Sprintf("[gray]%s rating: [green]%s[gray] %s → %s (%+d), [green]%s[gray] %s → %s (%+d)[white]\n", speed,
+			strings.Title(white.Name), whiteBefore, whiteAfter, int(math.Round(whiteAfter.Rating-whiteBefore.Rating)),
+			strings.Title(black.Name), blackBefore, blackAfter, int(math.Round(blackAfter.Rating-blackBefore.Rating))),
+	}
+	for _, p := range m.Players {
+		p.Send(message)
+	}
+}
+
+func (m *Match) Speed() Speed {
+	return m.Control.Speed()
+}
+
+func (m *Match) rating(p *Player) Rating {
+	if acc := m.Server.Accounts.Get(p.Identity); acc != nil {
+		return acc.Rating(m.Speed())
+	}
+	return NewRating()
+}
+
+// Name of the player followed by the rating if the player has one, e.g: Alice (1500?)
+func (m *Match) displayName(p *Player) string {
+	if p.Identity == "" || m.Server == nil {
+		return strings.Title(p.Name)
+	}
+	return fmt.Sprintf("%s (%s)", strings.Title(p.Name), m.rating(p))
+}
+
+func (m *Match) playerName(role PlayerRole) string {
+	if m.PracticeMode && role == m.EngineRole {
+		if m.PracticeElo > 0 {
+			return fmt.Sprintf("%s %d Elo", m.Engines.Name, m.PracticeElo)
+		}
+		return fmt.Sprintf("%s level %d", m.Engines.Name, m.PracticeLevel)
+	}
+	if p, ok := m.Players[int(role)]; ok && p.Name != "" {
+		return strings.Title(p.Name)
+	}
+	return "?"
 }
 
 func (m *Match) GameFEN() string {
 	return m.Game.Position().String()
 }
 
+// broadcastGame sends the position and the clocks as of now to everyone in the match
+func (m *Match) broadcastGame() {
+	message := MessageGame{
+		Fen:        m.GameFEN(),
+		Moves:      m.GameMoves(),
+		WhiteClock: m.Clocks[int(White)].Left(),
+		BlackClock: m.Clocks[int(Black)].Left(),
+	}
+	for _, p := range m.Players {
+		message.IsTurn = p.Role == m.Turn
+		p.Send(message)
+	}
+}
+
 func (m *Match) GameMoves() []string {
 	var moves []string
 	for _, move := range m.Game.Moves() {
@@ -122,38 +516,93 @@ func (m *Match) isPlayer() bool {
 	return false
 }
 
-func (m *Match) availableRole() PlayerRole {
-	if _, ok := m.Players[int(White)]; !ok {
-		return White
-	} else if _, ok := m.Players[int(Black)]; !ok {
-		return Black
+// The first free seat, seats reserved for someone else are skipped
+func (m *Match) availableRole(key string) PlayerRole {
+	for _, role := range []PlayerRole{White, Black} {
+		if _, taken := m.Players[int(role)]; taken || (m.PracticeMode && role == m.EngineRole) {
+			continue
+		}
+		if reserved, ok := m.Seats[role]; ok && reserved != key {
+			continue
+		}
+		return role
 	}
 	return Viewer
 }
 
-func (m *Match) AddConn(conn net.Conn, name string) {
-	p := NewPlayer(conn, name)
+// AddConn seats the client in the first free seat, or as a viewer. False when the match is closed
+func (m *Match) AddConn(sconn *ServerConn) bool {
+	return m.Do(func() {
+		m.addConnAs(sconn, m.availableRole(sconn.SeatKey()))
+	})
+}
+
+func (m *Match) AddConnAs(sconn *ServerConn, role PlayerRole) bool {
+	return m.Do(func() {
+		m.addConnAs(sconn, role)
+	})
+}
+
+func (m *Match) addConnAs(sconn *ServerConn, role PlayerRole) {
+	// A player coming back after a dropped connection
+	held, back := m.Held[role]
+	if back {
+		held.Timer.Stop()
+		delete(m.Held, role)
+		if sconn.Name == "" {
+			sconn.Name = held.Player.Name
+		}
+		if sconn.Identity == "" {
+			sconn.Identity = held.Player.Identity
+		}
+	}
 
-	role := m.availableRole()
+	p := NewPlayer(sconn)
 	p.Role = role
 	// Id of white, black player is unique, Viewer instead can have as many as we want
 	if role == Black || role == White {
 		p.Id = int(role)
-		go p.HandleRead(m.In)
+		if _, ok := m.Sessions[role]; !ok {
+			m.Sessions[role] = NewToken()
+		}
 	} else {
-		p.Id = int(Viewer) + len(m.Players)
+		m.viewerCount++
+		p.Id = int(Viewer) + m.viewerCount
 	}
 	m.Players[p.Id] = p
 
-	go p.HandleWrite()
+	go p.HandleRead(m)
 
 	// Connect player to the game
-	p.Out <- MessageConnect{
+	p.Send(MessageConnect{
 		Fen:        m.GameFEN(),
 		IsTurn:     m.Turn == p.Role,
 		Role:       p.Role,
-		WhiteClock: m.Clocks[int(White)],
-		BlackClock: m.Clocks[int(Black)],
+		WhiteClock: m.Clocks[int(White)].Snapshot(),
+		BlackClock: m.Clocks[int(Black)].Snapshot(),
+		Berserk:    m.canBerserk(p.Role),
+		Match:      m.Name,
+		Moves:      m.GameMoves(),
+		Token:      m.Sessions[p.Role],
+		Practice:   m.PracticeMode,
+		AutoQueen:  m.autoQueen(sconn.Identity),
+	})
+	if back {
+		for id, pl := range m.Players {
+			if id != p.Id {
+				pl.Send(MessageGameStatus{Message: "Opponent is back!"})
+			}
+		}
+		log.Printf("%s is back in match %s", p.Name, m.Name)
+		if m.Suspended {
+			m.resume()
+		}
+		return
+	}
+
+	// The engine opens the game when it plays White
+	if m.PracticeMode && role != Viewer && m.Turn == m.EngineRole && len(m.Game.Moves()) == 0 {
+		go m.post(MessageMatchEngineMove{})
 	}
 
 	// Broadcast new player for all player in the game
@@ -161,194 +610,543 @@ func (m *Match) AddConn(conn net.Conn, name string) {
 		if id == p.Id {
 			continue
 		}
-		pl.Out <- MessageGameChat{
-			Message: fmt.Sprintf("[gray]Player [green]%s[gray] has joined[white]", strings.Title(p.Name)),
-		}
+		pl.Send(MessageGameChat{
+			Message: fmt.Sprintf("[gray]Player [green]%s[gray] has joined[white]\n", m.displayName(p)),
+		})
 	}
 
-	p.Out <- MessageGameChat{
+	rated := "casual"
+	if m.Rated {
+		rated = "rated"
+	}
+	opponents := ""
+	for _, role := range []PlayerRole{White, Black} {
+		if pl, ok := m.Players[int(role)]; ok && pl.Id != p.Id {
+			opponents += fmt.Sprintf("%s: [green]%s[gray]. ", role, m.displayName(pl))
+		}
+	}
+	p.Send(MessageGameChat{
 		Message: fmt.Sprintf(`[gray]You have joined room [red]%s[gray] as [red]%s[gray] player with name [green]%s[white].
+[gray]This is a %s %s game. %s
 To move piece: [green]click[white] on piece to select and [green]click[white] again on destination
 Also, you might want to zoom in to see the pieces clearer! Have fun :)
-`, m.Name, p.Role, strings.Title(p.Name)),
-	}
+`, m.Name, p.Role, m.displayName(p), rated, m.Speed(), opponents),
+	})
 
 	log.Printf("Added a Player: %s", p.Role)
 }
 
-func (m *Match) HandleRead() {
-	for inMessage := range m.In {
-		messageTransport := inMessage.(MessageTransport)
-		switch messageTransport.MsgType {
-
-		case TypeMessageMatchRemovePlayer:
-			var message MessageMatchRemovePlayer
-			Decode(messageTransport.Data, &message)
-			m.Players[message.PlayerId].Disconnect()
-			delete(m.Players, message.PlayerId)
-
-		case TypeMessageMove:
-			var message MessageMove
-			Decode(messageTransport.Data, &message)
-			// Validate if the sender is the one who allowed to move
-			if m.Players[messageTransport.PlayerId].Role == m.Turn {
-				m.Game.MoveStr(message.Move)
-				// Switch turn
-				if m.Turn == White {
-					m.Turn = Black
-					m.Clocks[int(Black)].Tick()
-					m.Clocks[int(White)].Pause()
-				} else {
-					m.Turn = White
-					m.Clocks[int(White)].Tick()
-					m.Clocks[int(Black)].Pause()
-				}
-				message := MessageGame{Fen: m.GameFEN(), Moves: m.GameMoves()}
-				for _, p := range m.Players { // Broadcast the game to all users
-					message.IsTurn = p.Role == m.Turn
-					p.Out <- message
-				}
+// rejectMove tells the player the move wasn't played and what the board really is
+func (m *Match) rejectMove(p *Player, move, reason string) {
+	log.Printf("Rejected move %q of %s in %s: %s", move, p.Name, m.Name, reason)
+	p.Send(MessageMoveRejected{Move: move, Reason: reason, Fen: m.GameFEN()})
+}
 
-				// Practice mode will move immediately after client move
-				if m.PracticeMode {
-					time.Sleep(time.Second / 2) // Fake processing time
-					m.Turn = White              // Player is always white
-					m.Game.MoveStr(m.NextMove())
-					message := MessageGame{Fen: m.GameFEN(), Moves: m.GameMoves()}
-					for _, p := range m.Players { // Broadcast the game to all users
-						message.IsTurn = p.Role == m.Turn
-						p.Out <- message
-					}
-					log.Println(m.Game.Moves())
-				}
+// autoQueen is the preference of the player for promotions, guests pick the piece every time
+func (m *Match) autoQueen(identity string) bool {
+	if m.Server == nil || m.Server.Accounts == nil {
+		return false
+	}
+	acc := m.Server.Accounts.Get(identity)
+	return acc != nil && acc.Preference("autoqueen") == "on"
+}
 
-				if m.Game.Outcome() != chess.NoOutcome {
-					for _, p := range m.Players { // Broadcast the game to all users
-						if (p.Role == White && m.Game.Outcome() == chess.WhiteWon) || (p.Role == Black && m.Game.Outcome() == chess.BlackWon) {
-							p.Out <- MessageGameAction{Action: ActionWin, Message: m.Game.Method().String()}
-						} else {
-							p.Out <- MessageGameAction{Action: ActionLose, Message: m.Game.Method().String()}
-						}
-					}
+// handle plays a message of a player, or one the match sent itself
+func (m *Match) handle(messageTransport MessageTransport) {
+	switch messageTransport.MsgType {
+	case TypeMessageMove, TypeMessageGameChat, TypeMessageGameAction:
+		if _, ok := m.Players[messageTransport.PlayerId]; !ok { // Left in the meantime
+			return
+		}
+	}
+	switch messageTransport.MsgType {
+
+	case TypeMessageMatchRemovePlayer:
+		var message MessageMatchRemovePlayer
+		messageTransport.Decode(&message)
+		p, ok := m.Players[message.PlayerId]
+		if !ok {
+			return
+		}
+		p.Disconnect()
+		delete(m.Players, message.PlayerId)
+		if p.Role != Viewer && !m.Over() {
+			m.hold(p, ReconnectGrace)
+		}
+
+	case TypeMessageMatchAbandon:
+		var message MessageMatchAbandon
+		messageTransport.Decode(&message)
+		if _, held := m.Held[message.Role]; !held || m.Over() {
+			return
+		}
+		if m.Suspended && len(m.Held) == 2 { // Nobody came back after the restart
+			log.Printf("Nobody came back to match %s", m.Name)
+			m.cancel()
+			return
+		}
+		delete(m.Held, message.Role)
+		m.abandon(message.Role)
+
+	case TypeMessageMatchEngineMove:
+		if m.PracticeMode && m.Turn == m.EngineRole && !m.Over() && !m.Suspended {
+			m.engineMove()
+		}
+
+	case TypeMessageMove:
+		var message MessageMove
+		messageTransport.Decode(&message)
+		p := m.Players[messageTransport.PlayerId]
+		// Validate if the sender is the one who allowed to move
+		switch {
+		case p.Role == Viewer:
+			m.rejectMove(p, message.Move, "Viewers can't move")
+		case m.Over():
+			m.rejectMove(p, message.Move, "The game is over")
+		case m.saved:
+			m.rejectMove(p, message.Move, "The server is restarting, the game goes on after it")
+		case m.Suspended:
+			m.rejectMove(p, message.Move, "The game goes on once both players are back")
+		case p.Role != m.Turn:
+			if p.reject(time.Now()) {
+				m.rejectMove(p, message.Move, "Not your turn")
+			}
+		default:
+			move, err := LegalMove(m.Game.Position(), message.Move)
+			if err != nil {
+				// A client doesn't send those, unless it was modified
+				if p.reject(time.Now()) {
+					m.rejectMove(p, message.Move, err.Error())
 				}
+				return
 			}
-		case TypeMessageGameChat:
-			var message MessageGameChat
-			Decode(messageTransport.Data, &message)
-
-			var senderName string
-			if m.Players[messageTransport.PlayerId].Name != "" {
-				senderName = m.Players[messageTransport.PlayerId].Name
+			// The time of the move is when it reached us, minus the time it spent on the network
+			now := time.Now()
+			clock := m.Clocks[int(m.Turn)]
+			clock.Stop(now, m.lag(m.Turn))
+			if clock.Remaining == 0 {
+				m.flag(m.Turn)
+				return
+			}
+			m.Game.Move(move)
+			m.State = MatchPlaying
+			m.clearOffers()
+			clock.Moved()
+			m.MoveClocks = append(m.MoveClocks, clock.Remaining)
+			// Switch turn
+			if m.Turn == White {
+				m.Turn = Black
 			} else {
-				senderName = fmt.Sprintf("ID[%v]", strconv.Itoa(messageTransport.PlayerId))
+				m.Turn = White
 			}
-			message.Name = senderName
-			for _, p := range m.Players { // Broadcast the game to all users
-				p.Out <- message
+			m.Clocks[int(m.Turn)].Start(now)
+			m.broadcastGame()
+
+			// Practice mode will move immediately after client move
+			if m.PracticeMode && m.Game.Outcome() == chess.NoOutcome {
+				m.engineMove()
+				return
 			}
-		case TypeMessageGameAction:
-			var message MessageGameAction
-			Decode(messageTransport.Data, &message)
-			switch message.Action {
-			case ActionResignYes:
-				for _, p := range m.Players {
-					if p.Id == messageTransport.PlayerId {
-						p.Out <- MessageGameAction{Action: ActionLose, Message: "by Resignation"}
-					} else {
-						p.Out <- MessageGameAction{Action: ActionWin, Message: "by Resigination"}
-					}
-				}
+			m.checkOutcome()
+		}
+	case TypeMessageGameChat:
+		var message MessageGameChat
+		messageTransport.Decode(&message)
 
-			case ActionTimeOut:
-				for _, p := range m.Players {
-					if p.Id == messageTransport.PlayerId {
-						p.Out <- MessageGameAction{Action: ActionLose, Message: "by Time Out"}
-					} else {
-						p.Out <- MessageGameAction{Action: ActionWin, Message: "by Time Out"}
-					}
+		var senderName string
+		if m.Players[messageTransport.PlayerId].Name != "" {
+			senderName = m.Players[messageTransport.PlayerId].Name
+		} else {
+			senderName = fmt.Sprintf("ID[%v]", strconv.Itoa(messageTransport.PlayerId))
+		}
+		message.Name = senderName
+		for _, p := range m.Players { // Broadcast the game to all users
+			p.Send(message)
+		}
+	case TypeMessageGameAction:
+		var message MessageGameAction
+		messageTransport.Decode(&message)
+		// Viewers can only leave
+		if m.Players[messageTransport.PlayerId].Role == Viewer && message.Action != ActionExit {
+			return
+		}
+		switch message.Action {
+		case ActionResignYes:
+			m.EndGame(m.outcomeAgainst(m.Players[messageTransport.PlayerId].Role), "Resignation")
+			for _, p := range m.Players {
+				if p.Id == messageTransport.PlayerId {
+					p.Send(MessageGameAction{Action: ActionLose, Message: "by Resignation"})
+				} else {
+					p.Send(MessageGameAction{Action: ActionWin, Message: "by Resigination"})
 				}
+			}
 
-			case ActionDrawOffer:
-				if m.PracticeMode {
-					for _, p := range m.Players {
-						p.Out <- MessageGameStatus{Message: "Rejected draw offer"}
-					}
-				}
-				for _, p := range m.Players {
-					if p.Id != messageTransport.PlayerId {
-						p.Out <- MessageGameAction{Action: ActionDrawOffer}
-						p.Out <- MessageGameStatus{Message: "Opponent offer draw!"}
-					}
+		case ActionTimeOut:
+			m.EndGame(m.outcomeAgainst(m.Players[messageTransport.PlayerId].Role), "Time Out")
+			for _, p := range m.Players {
+				if p.Id == messageTransport.PlayerId {
+					p.Send(MessageGameAction{Action: ActionLose, Message: "by Time Out"})
+				} else {
+					p.Send(MessageGameAction{Action: ActionWin, Message: "by Time Out"})
 				}
+			}
 
-			case ActionDrawAccept:
+		case ActionDrawOffer:
+			if m.PracticeMode {
 				for _, p := range m.Players {
-					p.Out <- MessageGameAction{Action: ActionDraw}
+					p.Send(MessageGameStatus{Message: "Rejected draw offer"})
+				}
+			}
+			role := m.Players[messageTransport.PlayerId].Role
+			if m.Over() || m.PracticeMode || role == Viewer {
+				return
+			}
+			m.DrawOffer = role
+			for _, p := range m.Players {
+				if p.Id != messageTransport.PlayerId {
+					p.Send(MessageGameAction{Action: ActionDrawOffer})
+					p.Send(MessageGameStatus{Message: "Opponent offer draw!"})
 				}
+			}
 
-			case ActionDrawReject:
-				for _, p := range m.Players {
-					if p.Id != messageTransport.PlayerId {
-						p.Out <- MessageGameStatus{Message: "Rejected draw offer"}
-					}
+		case ActionDrawAccept:
+			// Only the opponent of the one who offered, before a move withdrew it
+			if m.Over() || !offeredTo(m.DrawOffer, m.Players[messageTransport.PlayerId].Role) {
+				m.Players[messageTransport.PlayerId].Send(MessageGameStatus{Message: "No draw offer to accept"})
+				return
+			}
+			m.EndGame(chess.Draw, "Agreement")
+			for _, p := range m.Players {
+				p.Send(MessageGameAction{Action: ActionDraw})
+			}
+
+		case ActionDrawReject:
+			if !offeredTo(m.DrawOffer, m.Players[messageTransport.PlayerId].Role) {
+				return
+			}
+			m.DrawOffer = Viewer
+			for _, p := range m.Players {
+				if p.Id != messageTransport.PlayerId {
+					p.Send(MessageGameStatus{Message: "Rejected draw offer"})
 				}
+			}
 
-			// New Game
-			case ActionNewGameOffer:
-				if m.PracticeMode {
-					m.ReMatch()
-					message := MessageGame{Fen: m.GameFEN()}
-					for _, p := range m.Players {
-						message.IsTurn = p.Role == m.Turn
-						p.Out <- message
-					}
+		case ActionBerserk:
+			role := m.Players[messageTransport.PlayerId].Role
+			if !m.canBerserk(role) {
+				m.Players[messageTransport.PlayerId].Send(MessageGameStatus{Message: "Too late to berserk"})
+				return
+			}
+			m.Berserked[role] = true
+			clock := m.Clocks[int(role)]
+			clock.Duration /= 2
+			clock.Remaining = clock.Duration
+			for _, p := range m.Players {
+				p.Send(MessageGameAction{Action: ActionBerserk, Message: role.String()})
+				p.Send(MessageGameChat{Message: fmt.Sprintf("[gray]%s went [red]berserk[gray]![white]\n", m.playerName(role))})
+			}
 
-				} else {
-					for _, p := range m.Players {
-						if p.Id != messageTransport.PlayerId {
-							p.Out <- MessageGameAction{Action: ActionNewGameOffer}
-							p.Out <- MessageGameStatus{Message: "New Game?"}
-						}
-					}
+		case ActionHint:
+			p := m.Players[messageTransport.PlayerId]
+			if !m.PracticeMode || m.Over() || p.Role != m.Turn {
+				p.Send(MessageGameStatus{Message: "Hints are for your move in practice games"})
+				return
+			}
+			turn := m.Game.Position().Turn()
+			m.search(SearchLimits{MoveTime: HintMoveTime}, func(results uci.SearchResults, err error) {
+				if err != nil {
+					log.Printf("Engine failed to give a hint in %s: %v", m.Name, err)
+					p.Send(MessageGameStatus{Message: "No hint, the engine is busy"})
+					return
 				}
+				m.Hints[p.Role]++
+				p.Send(MessageHint{Move: results.BestMove.String()})
+				m.broadcastEval(results.Info, turn)
+				for _, pl := range m.Players {
+					pl.Send(MessageGameChat{Message: fmt.Sprintf("[gray]%s took a hint (%d so far)[white]\n", m.playerName(p.Role), m.Hints[p.Role])})
+				}
+			})
 
-			case ActionNewGameAccept:
+		case ActionAnalyze:
+			p := m.Players[messageTransport.PlayerId]
+			if !m.Over() || m.RecordId == "" {
+				p.Send(MessageGameStatus{Message: "Analysis is for finished games"})
+				return
+			}
+			p.Send(MessageGameStatus{Message: "Analyzing, it takes a moment..."})
+			id := m.RecordId
+			m.Server.AnalyzeRecord(id, func(record *GameRecord, err error) {
+				if err != nil {
+					log.Printf("Failed to analyze %s: %v", id, err)
+					p.Send(MessageGameStatus{Message: "Analysis failed, try again later"})
+					return
+				}
+				p.Send(MessageAnalysis{
+					Id:     record.Id,
+					Report: record.Analysis.Report(record.White, record.Black),
+					PGN:    record.PGN(),
+				})
+			})
+
+		// New Game
+		case ActionNewGameOffer:
+			if m.OnEnd != nil { // The result of the game counts for something else
+				m.Players[messageTransport.PlayerId].Send(MessageGameStatus{Message: "No rematch here, exit to continue"})
+			} else if m.PracticeMode {
 				m.ReMatch()
-				message := MessageGame{Fen: m.GameFEN()}
-				for _, p := range m.Players {
-					// TODO: switch color
-					message.IsTurn = p.Role == m.Turn
-					p.Out <- message
+				m.broadcastGame()
+				if m.Turn == m.EngineRole {
+					m.engineMove()
 				}
 
-			case ActionNewGameReject:
+			} else if role := m.Players[messageTransport.PlayerId].Role; role != Viewer {
+				m.RematchOffer = role
 				for _, p := range m.Players {
 					if p.Id != messageTransport.PlayerId {
-						p.Out <- MessageGameStatus{Message: "Rejected New Game offer"}
+						p.Send(MessageGameAction{Action: ActionNewGameOffer})
+						p.Send(MessageGameStatus{Message: "New Game?"})
 					}
 				}
+			}
 
-			// Exit
-			case ActionExit:
-				for _, p := range m.Players {
-					if p.Id != messageTransport.PlayerId {
-						p.Out <- MessageGameStatus{Message: "Opponent exited!"}
-					}
+		case ActionNewGameAccept:
+			if m.OnEnd != nil {
+				return
+			}
+			if !offeredTo(m.RematchOffer, m.Players[messageTransport.PlayerId].Role) {
+				m.Players[messageTransport.PlayerId].Send(MessageGameStatus{Message: "No new game offer to accept"})
+				return
+			}
+			m.ReMatch()
+			// TODO: switch color
+			m.broadcastGame()
+
+		case ActionNewGameReject:
+			if !offeredTo(m.RematchOffer, m.Players[messageTransport.PlayerId].Role) {
+				return
+			}
+			m.RematchOffer = Viewer
+			for _, p := range m.Players {
+				if p.Id != messageTransport.PlayerId {
+					p.Send(MessageGameStatus{Message: "Rejected New Game offer"})
 				}
+			}
 
-			default:
-				log.Printf("Received Unknown message")
+		// Exit
+		case ActionExit:
+			for _, p := range m.Players {
+				if p.Id != messageTransport.PlayerId {
+					p.Send(MessageGameStatus{Message: "Opponent exited!"})
+				}
+			}
+			// Back to the lobby
+			p := m.Players[messageTransport.PlayerId]
+			delete(m.Players, p.Id)
+			if p.Role != Viewer && !m.Over() {
+				if m.State == MatchPlaying { // Walking out of a game gives it up
+					m.abandon(p.Role)
+				} else {
+					m.hold(p, ReconnectGrace)
+				}
 			}
+			go m.Server.HandleConn(p.Conn)
+
+		default:
+			log.Printf("Received Unknown message")
 		}
 	}
 }
 
-func (m *Match) NextMove() string { // used for singple player mode
-	cmdPos := uci.CmdPosition{Position: m.Game.Position()}
-	cmdGo := uci.CmdGo{MoveTime: time.Second / time.Duration(200/math.Pow(float64(m.PracticeLevel), 2.))} // the higher the level the longer the compute
-	if err := m.Engine.Run(cmdPos, cmdGo); err != nil {
-		panic(err)
+// hold keeps the seat of a player whose connection dropped. The clock keeps running,
+// the game is forfeited if the player isn't back before the grace period is over
+func (m *Match) hold(p *Player, grace time.Duration) {
+	role := p.Role
+	// A guest only gets back in with the session token, see TypeMessageReconnect
+	m.Seats[role] = "session:" + m.Sessions[role]
+	if p.Conn.Identity != "" {
+		m.Seats[role] = p.Conn.Identity
+	}
+	m.Held[role] = &HeldSeat{
+		Player: p,
+		Timer: time.AfterFunc(grace, func() {
+			m.post(MessageMatchAbandon{Role: role})
+		}),
+	}
+	for _, pl := range m.Players {
+		pl.Send(MessageGameStatus{Message: fmt.Sprintf("Opponent disconnected, waiting %s for them to come back", grace)})
+	}
+	log.Printf("%s dropped from match %s, holding the seat", p.Name, m.Name)
+}
+
+// abandon ends the game against the player who left it
+func (m *Match) abandon(role PlayerRole) {
+	m.EndGame(m.outcomeAgainst(role), "Abandoned")
+	for _, p := range m.Players {
+		if p.Role == Viewer {
+			p.Send(MessageGameAction{Action: ActionWin, Message: fmt.Sprintf("Abandonment. Winner: %s", role.Opponent())})
+		} else {
+			p.Send(MessageGameAction{Action: ActionWin, Message: "Abandonment"})
+		}
+	}
+}
+
+// resume restarts the clocks of a game restored after a restart, once every player is back
+func (m *Match) resume() {
+	if m.saved { // The server is going down, it goes on after the restart
+		return
+	}
+	if len(m.Held) > 0 {
+		for _, p := range m.Players {
+			p.Send(MessageGameStatus{Message: "Waiting for the opponent to come back, the clocks are stopped"})
+		}
+		return
+	}
+	m.Suspended = false
+	m.Clocks[int(m.Turn)].Start(time.Now())
+	m.broadcastGame()
+	log.Printf("Resumed match %s", m.Name)
+	if m.PracticeMode && m.Turn == m.EngineRole {
+		go m.post(MessageMatchEngineMove{})
+	}
+}
+
+// HeldSeatOf returns the seat held for the ssh key, if it dropped from a game that isn't over.
+// Guests come back with the session token instead
+func (m *Match) HeldSeatOf(identity string) (role PlayerRole, ok bool) {
+	role = Viewer
+	if identity == "" {
+		return role, false
+	}
+	m.Do(func() {
+		for r, held := range m.Held {
+			if held.Player.Conn.Identity == identity && !m.Over() {
+				role, ok = r, true
+				return
+			}
+		}
+	})
+	return role, ok
+}
+
+// A player can berserk once, before making the first move
+func (m *Match) canBerserk(role PlayerRole) bool {
+	if !m.AllowBerserk || m.Over() || m.Berserked[role] {
+		return false
+	}
+	moves := len(m.Game.Moves())
+	return (role == White && moves == 0) || (role == Black && moves <= 1)
+}
+
+// Outcome of the game when the given role loses it
+func (m *Match) outcomeAgainst(role PlayerRole) chess.Outcome {
+	switch role {
+	case White:
+		return chess.BlackWon
+	case Black:
+		return chess.WhiteWon
+	default:
+		return chess.NoOutcome
+	}
+}
+
+// Ends the game when the last move did
+func (m *Match) checkOutcome() {
+	if m.Game.Outcome() == chess.NoOutcome {
+		return
+	}
+	m.EndGame(m.Game.Outcome(), m.Game.Method().String())
+	for _, p := range m.Players { // Broadcast the game to all users
+		if (p.Role == White && m.Game.Outcome() == chess.WhiteWon) || (p.Role == Black && m.Game.Outcome() == chess.BlackWon) {
+			p.Send(MessageGameAction{Action: ActionWin, Message: m.Game.Method().String()})
+		} else {
+			p.Send(MessageGameAction{Action: ActionLose, Message: m.Game.Method().String()})
+		}
+	}
+}
+
+// search runs the engine on the position off the match goroutine, then done runs on it.
+// The result is dropped if the position changed in the meantime or the match is being saved
+func (m *Match) search(limits SearchLimits, done func(results uci.SearchResults, err error)) {
+	game, ply := m.Game, len(m.Game.Moves())
+	// A copy, the position caches its moves and the match goes on with it
+	position, err := GameFromFEN(m.GameFEN())
+	if err != nil {
+		done(uci.SearchResults{}, err)
+		return
+	}
+	go func() {
+		results, err := m.Engines.Search(position.Position(), limits)
+		m.Do(func() {
+			if m.Game == game && len(game.Moves()) == ply && !m.Over() && !m.saved {
+				done(results, err)
+			}
+		})
+	}()
+}
+
+// engineMove plays the move of the engine in practice mode, on its clock
+func (m *Match) engineMove() {
+	turn := m.Game.Position().Turn()
+	m.search(m.engineLimits(), func(results uci.SearchResults, err error) {
+		m.playEngineMove(turn, results, err)
+	})
+}
+
+func (m *Match) playEngineMove(turn chess.Color, results uci.SearchResults, err error) {
+	if err != nil {
+		log.Printf("Engine failed to move in %s: %v", m.Name, err)
+		m.EndGame(m.outcomeAgainst(m.EngineRole), "Engine failure")
+		for _, p := range m.Players {
+			p.Send(MessageGameAction{Action: ActionWin, Message: "Engine failure"})
+		}
+		return
+	}
+	now := time.Now()
+	clock := m.Clocks[int(m.EngineRole)]
+	clock.Stop(now, 0)
+	if clock.Remaining == 0 {
+		m.flag(m.EngineRole)
+		return
+	}
+	m.Game.Move(results.BestMove)
+	m.State = MatchPlaying
+	m.clearOffers()
+	clock.Moved()
+	m.MoveClocks = append(m.MoveClocks, clock.Remaining)
+	m.Turn = m.EngineRole.Opponent()
+	m.Clocks[int(m.Turn)].Start(now)
+	m.broadcastGame()
+	m.broadcastEval(results.Info, turn)
+	m.checkOutcome()
+}
+
+// broadcastEval sends the score of a search, turn is the side that was to move
+func (m *Match) broadcastEval(info uci.Info, turn chess.Color) {
+	eval := MessageEval{Score: info.Score.CP, Mate: info.Score.Mate, Depth: info.Depth}
+	if turn == chess.Black {
+		eval.Score, eval.Mate = -eval.Score, -eval.Mate
+	}
+	for _, p := range m.Players {
+		p.Send(eval)
+	}
+}
+
+// The search of the engine: its level, or its clock in a timed game
+func (m *Match) engineLimits() SearchLimits {
+	limits := PracticeLimits(m.PracticeLevel)
+	if m.PracticeElo > 0 {
+		// As long as the level of the same strength
+		limits = PracticeLimits(SearchLimits{Elo: m.PracticeElo}.level())
+		limits.Elo = m.PracticeElo
+	}
+	if m.EngineClock {
+		white, black := m.Clocks[int(White)], m.Clocks[int(Black)]
+		limits.MoveTime = 0
+		limits.WhiteTime, limits.BlackTime = white.Left(), black.Left()
+		limits.WhiteIncrement, limits.BlackIncrement = white.Increment, black.Increment
+		if clock := m.Clocks[int(m.EngineRole)]; clock.PeriodEnd > 0 {
+			limits.MovesToGo = clock.PeriodEnd - clock.Moves
+		}
 	}
-	move := m.Engine.SearchResults().BestMove
-	return move.String()
+	return limits
 }
@@ -0,0 +1,105 @@
+package pkg
+
+import (
+	"github.com/notnil/chess"
+	"testing"
+	"time"
+)
+
+// waitFor polls the match until cond holds
+func waitFor(t *testing.T, m *Match, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var ok bool
+		m.Do(func() { ok = cond() })
+		if ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func roleOf(m *Match, sconn *ServerConn) PlayerRole {
+	role := Viewer
+	m.Do(func() {
+		for _, p := range m.Players {
+			if p.Conn == sconn {
+				role = p.Role
+			}
+		}
+	})
+	return role
+}
+
+func TestGuestNameDoesntTakeHeldSeat(t *testing.T) {
+	s := &Server{Matches: NewMatchRegistry()}
+	m := NewMatch(s, "held", false, 1, 0)
+	defer m.Close()
+
+	white, black := NewLocalServerConn(), NewLocalServerConn()
+	white.Name, black.Name = "alice", "bob"
+	defer black.Close()
+	m.AddConn(white)
+	m.AddConn(black)
+	white.Close()
+	waitFor(t, m, "the seat of white to be held", func() bool {
+		_, held := m.Held[White]
+		return held
+	})
+
+	imposter := NewLocalServerConn()
+	imposter.Name = "alice"
+	defer imposter.Close()
+	if role, ok := m.HeldSeatOf(imposter.Identity); ok {
+		t.Fatalf("guest named alice got the held %s seat", role)
+	}
+	m.AddConn(imposter)
+	if role := roleOf(m, imposter); role != Viewer {
+		t.Fatalf("guest named alice took the held %s seat", role)
+	}
+}
+
+func TestExitGivesUpGame(t *testing.T) {
+	s := &Server{Matches: NewMatchRegistry()}
+	s.Matchmaker = NewMatchmaker(s) // The one who exits is back in the lobby
+	m := NewMatch(s, "exit", false, 1, 0)
+	defer m.Close()
+
+	white, black := NewLocalServerConn(), NewLocalServerConn()
+	white.Name, black.Name = "alice", "bob"
+	defer white.Close()
+	defer black.Close()
+	m.AddConn(white)
+	m.AddConn(black)
+	m.Do(func() { m.State = MatchPlaying })
+
+	white.Deliver(MessageGameAction{Action: ActionExit})
+	waitFor(t, m, "the game to end", m.Over)
+
+	var outcome chess.Outcome
+	var termination string
+	m.Do(func() { outcome, termination = m.Outcome, m.Termination })
+	if outcome != chess.BlackWon || termination != "Abandoned" {
+		t.Fatalf("game ended %s by %q, want black to win by abandonment", outcome, termination)
+	}
+}
+
+func FuzzMatchHandle(f *testing.F) {
+	fuzzMessageSeeds(f)
+	s := newTestServer(f, f.TempDir())
+	defer s.Engines.Close()
+	f.Fuzz(func(t *testing.T, kind uint8, word, args string, playerId int) {
+		m := NewMatch(s, "fuzz", false, 1, 0)
+		defer m.Close()
+		for i := 0; i < 3; i++ { // White, black and a viewer
+			sconn := NewLocalServerConn()
+			defer sconn.Close()
+			m.AddConn(sconn)
+		}
+		messageTransport := Transport(fuzzClientMessage(kind, word, args))
+		messageTransport.PlayerId = playerId
+		m.Do(func() { m.handle(messageTransport) })
+	})
+}
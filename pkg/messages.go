@@ -2,10 +2,17 @@ package pkg
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
+	"reflect"
 	"time"
 )
 
+const (
+	MaxClientLineSize = 64 << 10 // a line is one message, clients have nothing big to say
+	MaxServerLineSize = 4 << 20  // the server sends whole games and reports
+)
+
 type MessageInterface interface {
 	Type() MessageType
 }
@@ -21,6 +28,18 @@ const (
 	TypeMessageGameStatus
 	TypeMessageMatchRemovePlayer
 	TypeMessageGameCommand
+	TypeMessageArchivedGame
+	TypeMessageIdentify
+	TypeMessageReconnect
+	TypeMessageMatchAbandon
+	TypeMessagePing
+	TypeMessagePong
+	TypeMessageMatchEngineMove
+	TypeMessageHint
+	TypeMessageEval
+	TypeMessageAnalysis
+	TypeMessageMoveRejected
+	TypeMessageError
 )
 
 func (m MessageType) String() string {
@@ -43,6 +62,30 @@ func (m MessageType) String() string {
 		return "TypeMessageMatchRemovePlayer"
 	case TypeMessageGameCommand:
 		return "TypeMessageGameCommand"
+	case TypeMessageArchivedGame:
+		return "TypeMessageArchivedGame"
+	case TypeMessageIdentify:
+		return "TypeMessageIdentify"
+	case TypeMessageReconnect:
+		return "TypeMessageReconnect"
+	case TypeMessageMatchAbandon:
+		return "TypeMessageMatchAbandon"
+	case TypeMessagePing:
+		return "TypeMessagePing"
+	case TypeMessagePong:
+		return "TypeMessagePong"
+	case TypeMessageMatchEngineMove:
+		return "TypeMessageMatchEngineMove"
+	case TypeMessageHint:
+		return "TypeMessageHint"
+	case TypeMessageEval:
+		return "TypeMessageEval"
+	case TypeMessageAnalysis:
+		return "TypeMessageAnalysis"
+	case TypeMessageMoveRejected:
+		return "TypeMessageMoveRejected"
+	case TypeMessageError:
+		return "TypeMessageError"
 	default:
 		return "Unknown MessageType"
 	}
@@ -56,11 +99,55 @@ func Encode(o interface{}) json.RawMessage {
 	return data
 }
 
-func Decode(data []byte, o interface{}) {
-	err := json.Unmarshal(data, o)
-	if err != nil {
-		log.Panic(err)
+// Decode fails on data that isn't the JSON of o. Messages of clients are checked
+// by DecodeClientMessage when they arrive, decoding them again can't fail
+func Decode(data []byte, o interface{}) error {
+	return json.Unmarshal(data, o)
+}
+
+// clientMessage is what a client is allowed to send, to decode the data into.
+// The other messages are the server's or internal to it
+func clientMessage(t MessageType) (interface{}, bool) {
+	switch t {
+	case TypeMessageMove:
+		return &MessageMove{}, true
+	case TypeMessageGameChat:
+		return &MessageGameChat{}, true
+	case TypeMessageGameAction:
+		return &MessageGameAction{}, true
+	case TypeMessageGameCommand:
+		return &MessageGameCommand{}, true
+	case TypeMessageIdentify:
+		return &MessageIdentify{}, true
+	case TypeMessageReconnect:
+		return &MessageReconnect{}, true
+	case TypeMessagePong:
+		return &MessagePong{}, true
+	default:
+		return nil, false
+	}
+}
+
+// DecodeClientMessage reads a line sent by a client: a transport with a message the client may send
+func DecodeClientMessage(line []byte) (MessageTransport, error) {
+	var messageTransport MessageTransport
+	if err := Decode(line, &messageTransport); err != nil {
+		return messageTransport, fmt.Errorf("malformed message: %v", err)
 	}
+	message, ok := clientMessage(messageTransport.MsgType)
+	if !ok {
+		return messageTransport, fmt.Errorf("unexpected message type: %s", messageTransport.MsgType)
+	}
+	if err := messageTransport.Decode(message); err != nil {
+		return messageTransport, fmt.Errorf("malformed %s: %v", messageTransport.MsgType, err)
+	}
+	return messageTransport, nil
+}
+
+// EncodeLine is a message as it goes on the wire: a transport in JSON on a line
+func EncodeLine(message MessageInterface) []byte {
+	b := Encode(MessageTransport{MsgType: message.Type(), Data: Encode(message)})
+	return append(b, '\n')
 }
 
 // Message types
@@ -70,6 +157,24 @@ type MessageTransport struct {
 	MsgType  MessageType
 	Data     json.RawMessage
 	PlayerId int
+	Message  MessageInterface `json:"-"` // the message as it is when it doesn't leave the process, instead of Data
+}
+
+// Transport carries a message within the process, it isn't encoded
+func Transport(message MessageInterface) MessageTransport {
+	return MessageTransport{MsgType: message.Type(), Message: message}
+}
+
+// Decode reads the message of the transport into o, a pointer to a message
+func (m MessageTransport) Decode(o interface{}) error {
+	if m.Message == nil {
+		return Decode(m.Data, o)
+	}
+	if message := reflect.ValueOf(m.Message); message.Type() == reflect.TypeOf(o).Elem() {
+		reflect.ValueOf(o).Elem().Set(message)
+		return nil
+	}
+	return Decode(Encode(m.Message), o)
 }
 
 func (m MessageTransport) Type() MessageType {
@@ -86,11 +191,33 @@ func (m MessageMove) Type() MessageType {
 	return TypeMessageMove
 }
 
+// The server didn't play the move, the board is as Fen says
+type MessageMoveRejected struct {
+	Move   string
+	Reason string
+	Fen    string
+}
+
+func (m MessageMoveRejected) Type() MessageType {
+	return TypeMessageMoveRejected
+}
+
+// The server couldn't read a message of the peer
+type MessageError struct {
+	Message string
+}
+
+func (m MessageError) Type() MessageType {
+	return TypeMessageError
+}
+
 // Game Update
 type MessageGame struct {
-	Fen    string
-	IsTurn bool
-	Moves  []string
+	Fen        string
+	IsTurn     bool
+	Moves      []string
+	WhiteClock time.Duration // remaining times when the message was sent
+	BlackClock time.Duration
 }
 
 func (m MessageGame) Type() MessageType {
@@ -104,13 +231,18 @@ type MessageConnect struct {
 	IsTurn     bool
 	BlackClock *Clock
 	WhiteClock *Clock
+	Berserk    bool // the player can still berserk
+	Match      string
+	Moves      []string
+	Token      string // session of the seat, used to reconnect. Empty for viewers
+	Practice   bool   // against the engine, hints are available
+	AutoQueen  bool   // promote to a queen without asking
 }
 
 func (m MessageConnect) Type() MessageType {
 	return TypeMessageConnect
 }
 
-//
 type MessageGameAction struct {
 	Action  Action
 	Message string
@@ -140,7 +272,6 @@ func (m MessageGameChat) Type() MessageType {
 	return TypeMessageGameChat
 }
 
-//
 type MessageGameStatus struct {
 	Message string
 }
@@ -149,7 +280,6 @@ func (m MessageGameStatus) Type() MessageType {
 	return TypeMessageGameStatus
 }
 
-//
 type MessageMatchRemovePlayer struct {
 	PlayerId int
 }
@@ -158,6 +288,108 @@ func (m MessageMatchRemovePlayer) Type() MessageType {
 	return TypeMessageMatchRemovePlayer
 }
 
+// A finished game loaded from the archive
+type MessageArchivedGame struct {
+	Id          string
+	White       string
+	Black       string
+	Result      string
+	Termination string
+	Moves       []string
+	WhiteClock  time.Duration
+	BlackClock  time.Duration
+	PGN         string
+}
+
+func (m MessageArchivedGame) Type() MessageType {
+	return TypeMessageArchivedGame
+}
+
+// Identity of an ssh player, sent by chessterm right after connecting
+type MessageIdentify struct {
+	Identity string
+	Token    string
+}
+
+func (m MessageIdentify) Type() MessageType {
+	return TypeMessageIdentify
+}
+
+// Sent by a client whose connection dropped to take its seat back
+type MessageReconnect struct {
+	Match string
+	Token string
+}
+
+func (m MessageReconnect) Type() MessageType {
+	return TypeMessageReconnect
+}
+
+// The grace period of a disconnected player is over
+type MessageMatchAbandon struct {
+	Role PlayerRole
+}
+
+func (m MessageMatchAbandon) Type() MessageType {
+	return TypeMessageMatchAbandon
+}
+
+// Asks a practice match for a move of the engine, when it plays first
+type MessageMatchEngineMove struct {
+}
+
+func (m MessageMatchEngineMove) Type() MessageType {
+	return TypeMessageMatchEngineMove
+}
+
+// The server measures the network lag of a client, which answers a ping right away with a pong
+type MessagePing struct {
+	SentAt time.Duration // since the server started, only the server reads it
+}
+
+func (m MessagePing) Type() MessageType {
+	return TypeMessagePing
+}
+
+type MessagePong struct {
+	SentAt time.Duration
+}
+
+func (m MessagePong) Type() MessageType {
+	return TypeMessagePong
+}
+
+// Best move suggested by the engine in practice mode
+type MessageHint struct {
+	Move string // UCI notation
+}
+
+func (m MessageHint) Type() MessageType {
+	return TypeMessageHint
+}
+
+// Evaluation of the position by the engine, from White's side
+type MessageEval struct {
+	Score int // centipawns
+	Mate  int // moves to mate, negative when Black mates. Score doesn't count when it's set
+	Depth int
+}
+
+func (m MessageEval) Type() MessageType {
+	return TypeMessageEval
+}
+
+// Engine review of a finished game, asked from the match
+type MessageAnalysis struct {
+	Id     string
+	Report string
+	PGN    string // annotated with the evaluations and the judgements
+}
+
+func (m MessageAnalysis) Type() MessageType {
+	return TypeMessageAnalysis
+}
+
 // ACTIONS
 type Action string
 
@@ -178,16 +410,29 @@ const (
 	ActionLose                 = "Lose"
 	ActionDraw                 = "Draw"
 	ActionTimeOut              = "Time Out"
+	ActionBack                 = "Back"
+	ActionBerserk              = "Berserk"
+	ActionHint                 = "Hint"
+	ActionEval                 = "Eval"
+	ActionAnalyze              = "Analyze"
 )
 
 // COMMANDS
 type Command string
 
 const (
-	CommandLs       Command = "ls"
-	CommandCreate           = "create"
-	CommandJoin             = "join"
-	CommandCallme           = "callme"
-	CommandMessage          = "message"
-	CommandPractice         = "practice"
+	CommandLs             Command = "ls"
+	CommandCreate                 = "create"
+	CommandJoin                   = "join"
+	CommandCallme                 = "callme"
+	CommandMessage                = "message"
+	CommandPractice               = "practice"
+	CommandHistory                = "history"
+	CommandSet                    = "set"
+	CommandLeaderboard            = "leaderboard"
+	CommandSeek                   = "seek"
+	CommandTournament             = "tournament"
+	CommandArena                  = "arena"
+	CommandCorrespondence         = "corr"
+	CommandAnalyze                = "analyze"
 )
@@ -0,0 +1,93 @@
+package pkg
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// Lines a client could send, the fuzzer mutates them
+func clientLineSeeds() [][]byte {
+	seeds := [][]byte{
+		[]byte(""),
+		[]byte("{}"),
+		[]byte("null"),
+		[]byte(`{"MsgType":"MessageMove","Data":null}`),
+		[]byte(`{"MsgType":"MessageMove","Data":"e2e4"}`),
+		[]byte(`{"MsgType":"MessageGameCommand","Data":{"Command":"create","Argument":null}}`),
+		[]byte(`{"MsgType":"MessageConnect","Data":{}}`),
+		[]byte(`{"MsgType":7,"Data":[1,2]}`),
+	}
+	for _, message := range []MessageInterface{
+		MessageMove{Move: "e2e4"},
+		MessageGameChat{Message: "hi", Name: "someone", Time: time.Unix(0, 0)},
+		MessageGameAction{Action: ActionDrawOffer},
+		MessageGameCommand{Command: CommandCreate, Argument: []string{"match", "10+5"}},
+		MessageIdentify{Identity: "SHA256:key", Token: "token"},
+		MessageReconnect{Match: "match", Token: "token"},
+		MessagePong{SentAt: time.Second},
+	} {
+		seeds = append(seeds, EncodeLine(message))
+	}
+	return seeds
+}
+
+func FuzzDecodeClientMessage(f *testing.F) {
+	for _, seed := range clientLineSeeds() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line []byte) {
+		messageTransport, err := DecodeClientMessage(line)
+		if err != nil {
+			return
+		}
+		message, ok := clientMessage(messageTransport.MsgType)
+		if !ok {
+			t.Fatalf("accepted a %s from a client", messageTransport.MsgType)
+		}
+		if err := messageTransport.Decode(message); err != nil {
+			t.Fatalf("accepted %q but its data doesn't decode: %v", line, err)
+		}
+		// What the server decoded goes through the wire again the same way
+		again, err := DecodeClientMessage(EncodeLine(message.(MessageInterface)))
+		if err != nil {
+			t.Fatalf("%#v doesn't decode once encoded: %v", message, err)
+		}
+		if again.MsgType != messageTransport.MsgType {
+			t.Fatalf("%s came back as %s", messageTransport.MsgType, again.MsgType)
+		}
+	})
+}
+
+func FuzzHandleRead(f *testing.F) {
+	for _, seed := range clientLineSeeds() {
+		f.Add(append(seed, '\n'))
+	}
+	f.Add([]byte("garbage\n{\n}\n\n\x00\xff\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		client, server := net.Pipe()
+		sconn := NewServerConn(server)
+		go io.Copy(ioutil.Discard, client)
+		go func() {
+			client.Write(data)
+			client.Close()
+		}()
+
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case messageTransport, ok := <-sconn.In:
+				if !ok {
+					return
+				}
+				if _, allowed := clientMessage(messageTransport.MsgType); !allowed || messageTransport.MsgType == TypeMessagePong {
+					t.Fatalf("%s went through to the match", messageTransport.MsgType)
+				}
+			case <-timeout:
+				t.Fatal("the connection wasn't closed after the client hung up")
+			}
+		}
+	})
+}
@@ -0,0 +1,141 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"github.com/notnil/chess"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrPromotionMissing = errors.New("pick a piece to promote the pawn to")
+	ErrPromotionInvalid = errors.New("only a pawn reaching the last rank promotes, to a queen, rook, bishop or knight")
+)
+
+// normalizeSAN makes typed moves comparable with the SAN of the legal moves:
+// no check or capture marks, castling with O and forgiving on the case of the pieces
+func normalizeSAN(s string) string {
+	s = strings.TrimSpace(s)
+	for _, mark := range []string{"e.p.", "+", "#", "!", "?", "x", ":", "=", "-"} {
+		s = strings.ReplaceAll(s, mark, "")
+	}
+	s = strings.NewReplacer("0", "O", "o", "O").Replace(s)
+	// b is a pawn, the bishop has to be typed B
+	if len(s) > 0 && strings.ContainsRune("nrqk", rune(s[0])) {
+		s = strings.ToUpper(s[:1]) + s[1:]
+	}
+	if n := len(s); n >= 3 && strings.ContainsRune("nbrq", rune(s[n-1])) && s[n-2] >= '1' && s[n-2] <= '8' {
+		s = s[:n-1] + strings.ToUpper(s[n-1:])
+	}
+	return s
+}
+
+// minimalSAN drops what tells two moves apart: the square a piece comes from and the promotion
+func minimalSAN(s string) string {
+	if n := len(s); n >= 3 && strings.ContainsRune("NBRQ", rune(s[n-1])) && s[n-2] >= '1' && s[n-2] <= '8' {
+		s = s[:n-1]
+	}
+	if len(s) > 3 && strings.ContainsRune("NBRQK", rune(s[0])) {
+		s = s[:1] + s[len(s)-2:]
+	}
+	return s
+}
+
+// ParseMove reads a move typed in UCI (g1f3) or SAN (Nf3, exd5, O-O, e8=N).
+// A move that could be several legal ones is an error listing them
+func ParseMove(position *chess.Position, text string) (*chess.Move, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil, fmt.Errorf("no move")
+	}
+	valid := position.ValidMoves()
+	uci := strings.ToLower(text)
+	for _, m := range valid {
+		if m.String() == uci {
+			return m, nil
+		}
+	}
+
+	input := normalizeSAN(text)
+	var candidates []*chess.Move
+	for _, m := range valid {
+		san := normalizeSAN(chess.AlgebraicNotation{}.Encode(position, m))
+		if san == input {
+			return m, nil
+		}
+		if minimalSAN(san) == input {
+			candidates = append(candidates, m)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return nil, fmt.Errorf("%s is not a legal move", text)
+	case 1:
+		return candidates[0], nil
+	}
+	var sans []string
+	for _, m := range candidates {
+		sans = append(sans, chess.AlgebraicNotation{}.Encode(position, m))
+	}
+	return nil, fmt.Errorf("%s is ambiguous: %s", text, strings.Join(sans, ", "))
+}
+
+// CompleteMoves lists the legal moves starting with what was typed, in SAN or in UCI
+func CompleteMoves(position *chess.Position, prefix string) []string {
+	prefix = strings.TrimSpace(prefix)
+	if prefix == "" {
+		return nil
+	}
+	input := normalizeSAN(prefix)
+	uci := strings.ToLower(prefix)
+	var moves []string
+	for _, m := range position.ValidMoves() {
+		san := chess.AlgebraicNotation{}.Encode(position, m)
+		if normalized := normalizeSAN(san); strings.HasPrefix(normalized, input) || strings.HasPrefix(minimalSAN(normalized), input) {
+			moves = append(moves, san)
+		} else if strings.HasPrefix(m.String(), uci) {
+			moves = append(moves, m.String())
+		}
+	}
+	sort.Strings(moves)
+	return moves
+}
+
+// CheckPromotion makes sure a move in UCI names the piece a pawn becomes, and only then.
+// Other mistakes are left to the game
+func CheckPromotion(position *chess.Position, move string) error {
+	if len(move) == 5 && !strings.ContainsRune("qrbn", rune(move[4])) {
+		return ErrPromotionInvalid
+	}
+	m, err := chess.UCINotation{}.Decode(position, move)
+	if err != nil {
+		return nil
+	}
+	rank := m.S2().Rank()
+	promotes := position.Board().Piece(m.S1()).Type() == chess.Pawn && (rank == chess.Rank8 || rank == chess.Rank1)
+	switch {
+	case promotes && m.Promo() == chess.NoPieceType:
+		return ErrPromotionMissing
+	case !promotes && m.Promo() != chess.NoPieceType:
+		return ErrPromotionInvalid
+	}
+	return nil
+}
+
+// LegalMove is the move in UCI the server accepts: well formed, legal in the position and with the promotion right
+func LegalMove(position *chess.Position, move string) (*chess.Move, error) {
+	uci := chess.UCINotation{}
+	if _, err := uci.Decode(position, move); err != nil {
+		return nil, fmt.Errorf("malformed move %q", move)
+	}
+	if err := CheckPromotion(position, move); err != nil {
+		return nil, err
+	}
+	for _, m := range position.ValidMoves() {
+		if m.String() == move {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not a legal move", move)
+}
@@ -0,0 +1,78 @@
+package pkg
+
+import (
+	"github.com/notnil/chess"
+	"testing"
+)
+
+// Positions with castling, en passant, promotions and ambiguous moves
+var fuzzPositions = []string{
+	"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1",
+	"r3k2r/pppq1ppp/2n2n2/3pp3/1b1PP1b1/2N2N2/PPPQ1PPP/R3K2R w KQkq - 0 8",
+	"rnbqkbnr/ppp1p1pp/8/3pPp2/8/8/PPPP1PPP/RNBQKBNR w KQkq f6 0 3",
+	"1n2k3/P6P/8/8/8/8/p6p/1N2K3 w - - 0 1",
+	"4k3/8/8/2N3N1/8/2N3N1/8/4K3 w - - 0 1",
+	"7k/5Q2/6K1/8/8/8/8/8 b - - 0 1",
+}
+
+func fuzzPosition(t *testing.T, index uint8) *chess.Position {
+	fen, err := chess.FEN(fuzzPositions[int(index)%len(fuzzPositions)])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chess.NewGame(fen).Position()
+}
+
+func isValid(position *chess.Position, move *chess.Move) bool {
+	for _, m := range position.ValidMoves() {
+		if m.String() == move.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func FuzzParseMove(f *testing.F) {
+	for i := range fuzzPositions {
+		for _, text := range []string{"e4", "e2e4", "Nf3", "nf3", "O-O", "0-0-0", "exf6", "exf6 e.p.", "a8=Q", "a8q", "axb8=N+", "Ne4", "Nce4", "N5e4", "Qf8#", " Kg7 ", "", "z9", "e9e4"} {
+			f.Add(uint8(i), text)
+		}
+	}
+	f.Fuzz(func(t *testing.T, index uint8, text string) {
+		position := fuzzPosition(t, index)
+		move, err := ParseMove(position, text)
+		if err != nil {
+			if move != nil {
+				t.Fatalf("%q gave both %s and %v", text, move, err)
+			}
+			return
+		}
+		if !isValid(position, move) {
+			t.Fatalf("%q was read as %s, which isn't legal", text, move)
+		}
+		if _, err := LegalMove(position, move.String()); err != nil {
+			t.Fatalf("%q was read as %s, the server refuses it: %v", text, move, err)
+		}
+	})
+}
+
+func FuzzCompleteMoves(f *testing.F) {
+	for i := range fuzzPositions {
+		for _, prefix := range []string{"e", "N", "n", "O", "0-", "a8", "ax", "e2", "g1f", "Q", "x", " ", "="} {
+			f.Add(uint8(i), prefix)
+		}
+	}
+	f.Fuzz(func(t *testing.T, index uint8, prefix string) {
+		position := fuzzPosition(t, index)
+		for _, completion := range CompleteMoves(position, prefix) {
+			// Picking a completion plays a legal move
+			move, err := ParseMove(position, completion)
+			if err != nil {
+				t.Fatalf("completion %q of %q doesn't parse: %v", completion, prefix, err)
+			}
+			if !isValid(position, move) {
+				t.Fatalf("completion %q of %q is %s, which isn't legal", completion, prefix, move)
+			}
+		}
+	})
+}
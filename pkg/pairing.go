@@ -0,0 +1,161 @@
+package pkg
+
+import (
+	"sort"
+)
+
+// PairingSearchLimit bounds the backtracking of the Swiss pairing, it's exponential in the worst case.
+// Past it, repeated pairings are allowed
+const PairingSearchLimit = 10000
+
+// A game of a tournament round. Black is nil when White gets a bye
+type Pairing struct {
+	White     *TournamentPlayer
+	Black     *TournamentPlayer
+	Match     *Match
+	Result    float64 // score of white
+	Forfeited bool    // neither player showed up, both lose
+	Done      bool
+}
+
+// BergerPairings returns the pairings of round (0 based) of a round robin between n players,
+// as index pairs of white and black. An index equal to n is the bye of an odd field.
+// It's the circle method of the Berger tables: the last player is fixed and alternates colors,
+// every other pair in a round sums up to the same value modulo n-1
+func BergerPairings(n, round int) [][2]int {
+	if n%2 == 1 {
+		n++ // the dummy player n-1 is the bye
+	}
+	m := n - 1
+	r := round % m
+
+	var pairs [][2]int
+	if r%2 == 0 {
+		pairs = append(pairs, [2]int{r, m})
+	} else {
+		pairs = append(pairs, [2]int{m, r})
+	}
+	for i := 1; i < n/2; i++ {
+		pairs = append(pairs, [2]int{(r + i) % m, (r - i + m) % m})
+	}
+	return pairs
+}
+
+// RoundRobinRounds is the number of rounds needed for everyone to meet everyone
+func RoundRobinRounds(n int) int {
+	if n%2 == 1 {
+		return n
+	}
+	return n - 1
+}
+
+// PairSwiss pairs the next round with the Dutch system: players are sorted by score then rating,
+// each score group is split in two halves and the top half plays the bottom half in order.
+// Repeated pairings are avoided by trying the next candidate, and players float down to the
+// next score group when their group can't be paired. The player with the lowest rank who hasn't
+// had a bye yet gets the bye of an odd field
+func PairSwiss(players []*TournamentPlayer) (pairs [][2]*TournamentPlayer, bye *TournamentPlayer) {
+	ranked := append([]*TournamentPlayer(nil), players...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].Score != ranked[j].Score {
+			return ranked[i].Score > ranked[j].Score
+		}
+		return ranked[i].Rating > ranked[j].Rating
+	})
+
+	if len(ranked)%2 == 1 {
+		byeIndex := len(ranked) - 1
+		for i := len(ranked) - 1; i >= 0; i-- {
+			if ranked[i].Byes == 0 {
+				byeIndex = i
+				break
+			}
+		}
+		bye = ranked[byeIndex]
+		ranked = append(ranked[:byeIndex], ranked[byeIndex+1:]...)
+	}
+
+	budget := PairingSearchLimit
+	pairs, ok := pairDutch(ranked, false, &budget)
+	if !ok {
+		// Everybody has met everybody, or no pairing was found in time.
+		// Repeating a pairing is better than not playing
+		budget = PairingSearchLimit
+		pairs, _ = pairDutch(ranked, true, &budget)
+	}
+	for i, pair := range pairs {
+		pairs[i] = assignColors(pair[0], pair[1], i)
+	}
+	return pairs, bye
+}
+
+// pairDutch pairs the top player with the first candidate that lets the rest be paired.
+// Each call spends one of budget, the search gives up when it's spent
+func pairDutch(ranked []*TournamentPlayer, allowRepeat bool, budget *int) ([][2]*TournamentPlayer, bool) {
+	if len(ranked) == 0 {
+		return nil, true
+	}
+	if *budget <= 0 {
+		return nil, false
+	}
+	*budget--
+	top := ranked[0]
+
+	// The score group of the top player, the bottom half comes first as candidates
+	group := 1
+	for group < len(ranked) && ranked[group].Score == top.Score {
+		group++
+	}
+	half := group / 2
+	if half == 0 {
+		half = 1
+	}
+	var candidates []int
+	for i := half; i < group; i++ {
+		candidates = append(candidates, i)
+	}
+	for i := 1; i < half; i++ {
+		candidates = append(candidates, i)
+	}
+	for i := group; i < len(ranked); i++ { // float down
+		candidates = append(candidates, i)
+	}
+
+	for _, c := range candidates {
+		opponent := ranked[c]
+		if !allowRepeat && top.HasPlayed(opponent) {
+			continue
+		}
+		rest := make([]*TournamentPlayer, 0, len(ranked)-2)
+		for i, p := range ranked {
+			if i != 0 && i != c {
+				rest = append(rest, p)
+			}
+		}
+		if pairs, ok := pairDutch(rest, allowRepeat, budget); ok {
+			return append([][2]*TournamentPlayer{{top, opponent}}, pairs...), true
+		}
+	}
+	return nil, false
+}
+
+// The player who had black more often gets white, then the one who didn't have white last round.
+// In the first round colors alternate by board
+func assignColors(a, b *TournamentPlayer, board int) [2]*TournamentPlayer {
+	if da, db := a.ColorDifference(), b.ColorDifference(); da != db {
+		if da < db {
+			return [2]*TournamentPlayer{a, b}
+		}
+		return [2]*TournamentPlayer{b, a}
+	}
+	if la, lb := a.LastColor(), b.LastColor(); la != lb {
+		if la != White {
+			return [2]*TournamentPlayer{a, b}
+		}
+		return [2]*TournamentPlayer{b, a}
+	}
+	if board%2 == 0 {
+		return [2]*TournamentPlayer{a, b}
+	}
+	return [2]*TournamentPlayer{b, a}
+}
@@ -1,9 +1,13 @@
 package pkg
 
 import (
-	"bufio"
 	"log"
-	"net"
+	"time"
+)
+
+var (
+	MoveRejectLimit  = 10 // illegal moves a player can send within the window before they are ignored
+	MoveRejectWindow = time.Minute
 )
 
 type PlayerRole int
@@ -27,59 +31,83 @@ func (pc PlayerRole) String() string {
 	}
 }
 
+// Opponent is the other side of the board, viewers have none
+func (pc PlayerRole) Opponent() PlayerRole {
+	switch pc {
+	case White:
+		return Black
+	case Black:
+		return White
+	default:
+		return Viewer
+	}
+}
+
 type Player struct {
-	Conn net.Conn
-	Role PlayerRole
-	Out  chan MessageInterface
-	Id   int
-	Name string
+	Conn     *ServerConn
+	Role     PlayerRole
+	Out      chan MessageInterface
+	Id       int
+	Name     string
+	Identity string // ssh key fingerprint, empty for guests
 	// Time -- User time here
+	rejections []time.Time // of the illegal moves within MoveRejectWindow
 }
 
-func NewPlayer(conn net.Conn, name string) *Player {
-	out := make(chan MessageInterface, ConnQueueSize)
+func NewPlayer(sconn *ServerConn) *Player {
 	p := &Player{
-		Conn: conn,
-		Out:  out,
-		Name: name,
+		Conn:     sconn,
+		Out:      sconn.Out,
+		Name:     sconn.Name,
+		Identity: sconn.Identity,
 	}
 	return p
 }
 
-func (p *Player) HandleRead(In chan MessageInterface) {
-	// Receive message, add player info, then forward to server
-	defer p.Disconnect()
-	scanner := bufio.NewScanner(p.Conn)
-	var messageTransport MessageTransport
-	for scanner.Scan() {
-		Decode(scanner.Bytes(), &messageTransport)
-		messageTransport.PlayerId = p.Id
-		In <- messageTransport // Forward the message to server
-	}
-
-	message := MessageMatchRemovePlayer{
-		PlayerId: p.Id,
+// reject counts an illegal move of the player, false once there were too many lately
+func (p *Player) reject(now time.Time) bool {
+	recent := p.rejections[:0]
+	for _, at := range p.rejections {
+		if now.Sub(at) < MoveRejectWindow {
+			recent = append(recent, at)
+		}
 	}
-	In <- MessageTransport{
-		MsgType:  message.Type(),
-		Data:     Encode(message),
-		PlayerId: p.Id,
+	p.rejections = append(recent, now)
+	if len(p.rejections) == MoveRejectLimit+1 {
+		log.Printf("Player %s (%s) sent %d illegal moves within %s, ignoring their moves", p.Name, p.Identity, len(p.rejections), MoveRejectWindow)
 	}
-	log.Println("Player Disconnected")
+	return len(p.rejections) <= MoveRejectLimit
 }
 
-func (p *Player) HandleWrite() {
-	for message := range p.Out {
-		messageData := Encode(message)
-		messageTransport := &MessageTransport{MsgType: message.Type(), Data: messageData}
-		b := Encode(messageTransport)
-		if b[len(b)-1] != '\n' { // EOF
-			b = append(b, '\n')
+func (p *Player) HandleRead(m *Match) {
+	// Receive message, add player info, then forward to the match
+	for messageTransport := range p.Conn.In {
+		messageTransport.PlayerId = p.Id
+		select {
+		case m.In <- messageTransport:
+		case <-m.ctx.Done(): // The match is closed, it disconnected us
+			return
 		}
-		if _, err := p.Conn.Write(b); err != nil {
-			log.Printf("Failed to write: %v Error: %v", message, err)
+
+		// The connection goes back to the lobby, stop reading it
+		if messageTransport.MsgType == TypeMessageGameAction {
+			var message MessageGameAction
+			messageTransport.Decode(&message)
+			if message.Action == ActionExit {
+				return
+			}
 		}
 	}
+
+	m.post(MessageMatchRemovePlayer{PlayerId: p.Id})
+	log.Println("Player Disconnected")
+}
+
+// Send queues a message for the player, see ServerConn.Send
+func (p *Player) Send(message MessageInterface) {
+	if !p.Conn.Send(message) {
+		log.Printf("%s isn't reading their messages, disconnected", p.Name)
+	}
 }
 
 func (p *Player) Disconnect() {
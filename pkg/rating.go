@@ -0,0 +1,145 @@
+package pkg
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Glicko-2 rating system, see http://www.glicko.net/glicko/glicko2.pdf
+const (
+	RatingDefault      = 1500.
+	DeviationDefault   = 350.
+	VolatilityDefault  = 0.06
+	DeviationMin       = 45.
+	ProvisionalRD      = 110. // ratings with a deviation above this aren't trusted yet
+	glickoScale        = 173.7178
+	glickoTau          = 0.5
+	glickoConvergence  = 0.000001
+	LeaderboardLimit   = 10
+	LeaderboardMinimum = 1 // games required to show up on the leaderboard
+)
+
+// Time control categories, each one has its own rating
+type Speed string
+
+const (
+	SpeedBullet    Speed = "bullet"
+	SpeedBlitz     Speed = "blitz"
+	SpeedRapid     Speed = "rapid"
+	SpeedClassical Speed = "classical"
+	// Days per move, only correspondence games are rated in it
+	SpeedCorrespondence Speed = "correspondence"
+)
+
+var Speeds = []Speed{SpeedBullet, SpeedBlitz, SpeedRapid, SpeedClassical, SpeedCorrespondence}
+
+// SpeedOf estimates the game length as duration + 40 increments,
+// the same way lichess categorizes its games
+func SpeedOf(duration, increment time.Duration) Speed {
+	estimate := duration + 40*increment
+	switch {
+	case estimate < 3*time.Minute:
+		return SpeedBullet
+	case estimate < 8*time.Minute:
+		return SpeedBlitz
+	case estimate < 25*time.Minute:
+		return SpeedRapid
+	default:
+		return SpeedClassical
+	}
+}
+
+func ParseSpeed(s string) (Speed, bool) {
+	for _, speed := range Speeds {
+		if string(speed) == s {
+			return speed, true
+		}
+	}
+	return "", false
+}
+
+type Rating struct {
+	Rating     float64
+	Deviation  float64
+	Volatility float64
+	Games      int
+}
+
+func NewRating() Rating {
+	return Rating{
+		Rating:     RatingDefault,
+		Deviation:  DeviationDefault,
+		Volatility: VolatilityDefault,
+	}
+}
+
+func (r Rating) Provisional() bool {
+	return r.Deviation > ProvisionalRD
+}
+
+func (r Rating) String() string {
+	if r.Provisional() {
+		return fmt.Sprintf("%d?", int(math.Round(r.Rating)))
+	}
+	return fmt.Sprintf("%d", int(math.Round(r.Rating)))
+}
+
+// Update returns the rating after a single game against opponent.
+// score is 1 for a win, 0.5 for a draw and 0 for a loss
+func (r Rating) Update(opponent Rating, score float64) Rating {
+	// Step 2: convert to the Glicko-2 scale
+	mu := (r.Rating - RatingDefault) / glickoScale
+	phi := r.Deviation / glickoScale
+	muJ := (opponent.Rating - RatingDefault) / glickoScale
+	phiJ := opponent.Deviation / glickoScale
+
+	// Step 3, 4: estimated variance and improvement
+	g := 1 / math.Sqrt(1+3*phiJ*phiJ/(math.Pi*math.Pi))
+	e := 1 / (1 + math.Exp(-g*(mu-muJ)))
+	v := 1 / (g * g * e * (1 - e))
+	delta := v * g * (score - e)
+
+	// Step 5: new volatility, using the Illinois algorithm
+	a := math.Log(r.Volatility * r.Volatility)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		return ex*(delta*delta-phi*phi-v-ex)/(2*math.Pow(phi*phi+v+ex, 2)) - (x-a)/(glickoTau*glickoTau)
+	}
+	A := a
+	var B float64
+	if delta*delta > phi*phi+v {
+		B = math.Log(delta*delta - phi*phi - v)
+	} else {
+		k := 1.
+		for f(a-k*glickoTau) < 0 {
+			k++
+		}
+		B = a - k*glickoTau
+	}
+	fA, fB := f(A), f(B)
+	for math.Abs(B-A) > glickoConvergence {
+		C := A + (A-B)*fA/(fB-fA)
+		fC := f(C)
+		if fC*fB <= 0 {
+			A, fA = B, fB
+		} else {
+			fA /= 2
+		}
+		B, fB = C, fC
+	}
+	volatility := math.Exp(A / 2)
+
+	// Step 6, 7: new deviation and rating
+	phiStar := math.Sqrt(phi*phi + volatility*volatility)
+	newPhi := 1 / math.Sqrt(1/(phiStar*phiStar)+1/v)
+	newMu := mu + newPhi*newPhi*g*(score-e)
+
+	// Step 8: back to the Glicko scale
+	return Rating{
+		Rating:     newMu*glickoScale + RatingDefault,
+		Deviation:  math.Max(newPhi*glickoScale, DeviationMin),
+		Volatility: volatility,
+		Games:      r.Games + 1,
+	}
+}
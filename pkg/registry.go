@@ -0,0 +1,71 @@
+package pkg
+
+import (
+	"sort"
+	"sync"
+)
+
+// The matches of the server by name. Every lobby, the matchmaker, the tournaments and
+// the cleanup share it, so it's behind a lock
+type MatchRegistry struct {
+	mu      sync.RWMutex
+	matches map[string]*Match
+}
+
+func NewMatchRegistry() *MatchRegistry {
+	return &MatchRegistry{matches: make(map[string]*Match)}
+}
+
+func (r *MatchRegistry) Get(name string) (*Match, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	m, ok := r.matches[name]
+	return m, ok
+}
+
+func (r *MatchRegistry) Has(name string) bool {
+	_, ok := r.Get(name)
+	return ok
+}
+
+// Create adds the match made by newMatch unless the name is taken, then it returns the match
+// already there and false. newMatch runs under the lock, two clients can't create the same name
+func (r *MatchRegistry) Create(name string, newMatch func() *Match) (*Match, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m, ok := r.matches[name]; ok {
+		return m, false
+	}
+	m := newMatch()
+	r.matches[name] = m
+	return m, true
+}
+
+// Delete removes the match, unless another one took its name in the meantime
+func (r *MatchRegistry) Delete(m *Match) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.matches[m.Name] == m {
+		delete(r.matches, m.Name)
+	}
+}
+
+func (r *MatchRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.matches)
+}
+
+// Snapshot lists the matches sorted by name. Matches can come and go while the caller goes through it
+func (r *MatchRegistry) Snapshot() []*Match {
+	r.mu.RLock()
+	matches := make([]*Match, 0, len(r.matches))
+	for _, m := range r.matches {
+		matches = append(matches, m)
+	}
+	r.mu.RUnlock()
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Name < matches[j].Name
+	})
+	return matches
+}
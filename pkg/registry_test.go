@@ -0,0 +1,165 @@
+package pkg
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func newTestMatch(name string) *Match {
+	return NewMatch(nil, name, false, 1, 0)
+}
+
+func closeAll(r *MatchRegistry) {
+	for _, m := range r.Snapshot() {
+		m.Close()
+		r.Delete(m)
+	}
+}
+
+func TestMatchRegistryCreateOnce(t *testing.T) {
+	r := NewMatchRegistry()
+	defer closeAll(r)
+
+	const clients = 50
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	matches := make(map[*Match]bool)
+	created := 0
+	made := 0
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m, ok := r.Create("same", func() *Match {
+				mu.Lock()
+				made++
+				mu.Unlock()
+				return newTestMatch("same")
+			})
+			mu.Lock()
+			defer mu.Unlock()
+			matches[m] = true
+			if ok {
+				created++
+			}
+		}()
+	}
+	wg.Wait()
+
+	if created != 1 || made != 1 {
+		t.Fatalf("created %d matches and made %d, want 1", created, made)
+	}
+	if len(matches) != 1 {
+		t.Fatalf("clients got %d different matches, want 1", len(matches))
+	}
+	if r.Len() != 1 {
+		t.Fatalf("registry has %d matches, want 1", r.Len())
+	}
+}
+
+func TestMatchRegistryConcurrent(t *testing.T) {
+	r := NewMatchRegistry()
+	defer closeAll(r)
+
+	const (
+		workers = 8
+		rounds  = 200
+		names   = 5
+	)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				name := fmt.Sprintf("m%d", (w+i)%names)
+				switch i % 4 {
+				case 0:
+					m, created := r.Create(name, func() *Match { return newTestMatch(name) })
+					if m == nil || m.Name != name {
+						t.Errorf("Create(%s) returned %v, created %v", name, m, created)
+					}
+				case 1:
+					if m, ok := r.Get(name); ok {
+						// Only the match that is there goes away
+						if m.Name != name {
+							t.Errorf("Get(%s) returned match %s", name, m.Name)
+						}
+						r.Delete(m)
+						m.Close()
+					}
+				case 2:
+					for _, m := range r.Snapshot() {
+						m.Do(func() {})
+					}
+				case 3:
+					if n := r.Len(); n > names {
+						t.Errorf("registry has %d matches for %d names", n, names)
+					}
+					r.Has(name)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	snapshot := r.Snapshot()
+	for i := 1; i < len(snapshot); i++ {
+		if snapshot[i-1].Name >= snapshot[i].Name {
+			t.Fatalf("snapshot isn't sorted by name: %s before %s", snapshot[i-1].Name, snapshot[i].Name)
+		}
+	}
+	if len(snapshot) != r.Len() {
+		t.Fatalf("snapshot has %d matches, registry %d", len(snapshot), r.Len())
+	}
+}
+
+func TestMatchRegistryDeleteKeepsNewMatch(t *testing.T) {
+	r := NewMatchRegistry()
+	defer closeAll(r)
+
+	old, _ := r.Create("game", func() *Match { return newTestMatch("game") })
+	r.Delete(old)
+	old.Close()
+	fresh, created := r.Create("game", func() *Match { return newTestMatch("game") })
+	if !created {
+		t.Fatal("name of a deleted match wasn't free")
+	}
+	r.Delete(old) // Late cleanup of the old match
+	if m, ok := r.Get("game"); !ok || m != fresh {
+		t.Fatal("deleting the old match removed the new one")
+	}
+}
+
+func TestCreateNamedMatch(t *testing.T) {
+	s := &Server{Matches: NewMatchRegistry()}
+	defer closeAll(s.Matches)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	names := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m := s.createNamedMatch("cup-r1-b1", newTestMatch)
+			mu.Lock()
+			defer mu.Unlock()
+			if names[m.Name] {
+				t.Errorf("match %s was created twice", m.Name)
+			}
+			names[m.Name] = true
+		}()
+	}
+	wg.Wait()
+
+	if s.Matches.Len() != 20 {
+		t.Fatalf("registry has %d matches, want 20", s.Matches.Len())
+	}
+	for _, name := range []string{"cup-r1-b1", "cup-r1-b1-2", "cup-r1-b1-20"} {
+		if !names[name] {
+			t.Errorf("no match named %s", name)
+		}
+	}
+}
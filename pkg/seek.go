@@ -0,0 +1,156 @@
+package pkg
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	SeekDefaultDuration  = 10 // minutes
+	SeekDefaultIncrement = 0  // seconds
+	MatchmakingInterval  = time.Second
+	// Rating difference accepted between two seekers, it grows the longer they wait
+	SeekRangeInitial  = 100.
+	SeekRangeStep     = 50.
+	SeekRangeInterval = 5 * time.Second
+	SeekRangeMax      = 700.
+)
+
+// A player waiting for an opponent
+type Seek struct {
+	Conn      *ServerConn
+	Duration  int // minutes
+	Increment int // seconds
+	Rated     bool
+	Rating    float64
+	CreatedAt time.Time
+}
+
+func (sk *Seek) Speed() Speed {
+	return SpeedOf(time.Duration(sk.Duration)*time.Minute, time.Duration(sk.Increment)*time.Second)
+}
+
+// Range is the rating difference the seeker accepts after waiting until now
+func (sk *Seek) Range(now time.Time) float64 {
+	steps := float64(now.Sub(sk.CreatedAt) / SeekRangeInterval)
+	return math.Min(SeekRangeInitial+steps*SeekRangeStep, SeekRangeMax)
+}
+
+func (sk *Seek) Compatible(other *Seek, now time.Time) bool {
+	if sk.Conn == other.Conn || sk.Duration != other.Duration || sk.Increment != other.Increment || sk.Rated != other.Rated {
+		return false
+	}
+	// Don't pair someone with their own account in another session
+	if sk.Conn.Identity != "" && sk.Conn.Identity == other.Conn.Identity {
+		return false
+	}
+	diff := math.Abs(sk.Rating - other.Rating)
+	return diff <= sk.Range(now) && diff <= other.Range(now)
+}
+
+type Matchmaker struct {
+	Server *Server
+	mu     sync.Mutex
+	seeks  []*Seek // oldest first
+}
+
+func NewMatchmaker(s *Server) *Matchmaker {
+	return &Matchmaker{Server: s}
+}
+
+// Add puts the seek in the queue, replacing the previous seek of the same client
+func (mm *Matchmaker) Add(seek *Seek) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.remove(seek.Conn)
+	seek.CreatedAt = time.Now()
+	mm.seeks = append(mm.seeks, seek)
+}
+
+// Cancel removes the seek of the client, returns false if it wasn't seeking
+func (mm *Matchmaker) Cancel(sconn *ServerConn) bool {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return mm.remove(sconn)
+}
+
+func (mm *Matchmaker) Count() int {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	return len(mm.seeks)
+}
+
+// Caller must hold the lock
+func (mm *Matchmaker) remove(sconn *ServerConn) bool {
+	for i, seek := range mm.seeks {
+		if seek.Conn == sconn {
+			mm.seeks = append(mm.seeks[:i], mm.seeks[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (mm *Matchmaker) Run() {
+	tick := time.NewTicker(MatchmakingInterval)
+	for {
+		select {
+		case <-tick.C:
+			mm.Pair()
+		}
+	}
+}
+
+// Pair matches every seeker it can, the ones who waited the longest go first
+func (mm *Matchmaker) Pair() {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	now := time.Now()
+	for i := 0; i < len(mm.seeks); i++ {
+		seek := mm.seeks[i]
+		// Pick the compatible opponent with the closest rating
+		best := -1
+		for j := i + 1; j < len(mm.seeks); j++ {
+			if !seek.Compatible(mm.seeks[j], now) {
+				continue
+			}
+			if best == -1 || math.Abs(seek.Rating-mm.seeks[j].Rating) < math.Abs(seek.Rating-mm.seeks[best].Rating) {
+				best = j
+			}
+		}
+		if best == -1 {
+			continue
+		}
+
+		opponent := mm.seeks[best]
+		mm.seeks = append(mm.seeks[:best], mm.seeks[best+1:]...)
+		mm.seeks = append(mm.seeks[:i], mm.seeks[i+1:]...)
+		i--
+		mm.start(seek, opponent)
+	}
+}
+
+func (mm *Matchmaker) start(a, b *Seek) {
+	if rand.Intn(2) == 0 {
+		a, b = b, a
+	}
+	s := mm.Server
+	m := s.createMatch(func(name string) *Match {
+		m := NewMatch(s, name, false, a.Duration, a.Increment)
+		m.Rated = a.Rated
+		m.Seats[White] = a.Conn.SeatKey()
+		m.Seats[Black] = b.Conn.SeatKey()
+		return m
+	})
+	// A seeker who left before taking the seat doesn't keep the other one waiting
+	m.ExpectPlayers(NoShowTimeout)
+	log.Printf("Paired %s and %s in match %s", a.Conn.Name, b.Conn.Name, m.Name)
+
+	// The lobby of each client takes its seat
+	a.Conn.AssignSeat(Assignment{Match: m, Role: White})
+	b.Conn.AssignSeat(Assignment{Match: m, Role: Black})
+}
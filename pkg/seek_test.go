@@ -0,0 +1,59 @@
+package pkg
+
+import (
+	"github.com/notnil/chess"
+	"testing"
+	"time"
+)
+
+func TestMatchmakerForfeitsSeekerWhoLeft(t *testing.T) {
+	defer func(timeout time.Duration) { NoShowTimeout = timeout }(NoShowTimeout)
+	NoShowTimeout = 100 * time.Millisecond
+
+	s := &Server{Matches: NewMatchRegistry()}
+	s.Matchmaker = NewMatchmaker(s)
+	defer closeAll(s.Matches)
+
+	present, gone := NewLocalServerConn(), NewLocalServerConn()
+	present.Name, gone.Name = "present", "gone"
+	defer present.Close()
+	go s.HandleConn(present)
+
+	s.Matchmaker.Add(&Seek{Conn: present, Duration: 1, Rating: RatingDefault})
+	s.Matchmaker.Add(&Seek{Conn: gone, Duration: 1, Rating: RatingDefault})
+	gone.Close() // Hung up right before the pairing
+	s.Matchmaker.Pair()
+
+	matches := s.Matches.Snapshot()
+	if len(matches) != 1 {
+		t.Fatalf("%d matches after the pairing, want 1", len(matches))
+	}
+	m := matches[0]
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var over bool
+		var outcome chess.Outcome
+		var termination string
+		var presentRole PlayerRole = Viewer
+		m.Do(func() {
+			over, outcome, termination = m.Over(), m.Outcome, m.Termination
+			for _, p := range m.Players {
+				if p.Conn == present {
+					presentRole = p.Role
+				}
+			}
+		})
+		if over {
+			if termination != "No show" {
+				t.Fatalf("game ended by %q, want a no show", termination)
+			}
+			if outcome != m.outcomeAgainst(presentRole.Opponent()) {
+				t.Fatalf("%s won the game of %s who stayed", outcome, presentRole)
+			}
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("the player who stayed is still waiting for the one who left")
+}
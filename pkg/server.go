@@ -1,21 +1,23 @@
 package pkg
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"github.com/Pallinder/go-randomdata"
 	"github.com/creack/pty"
 	"github.com/gliderlabs/ssh"
-	"github.com/notnil/chess/uci"
+	gossh "golang.org/x/crypto/ssh"
 	"io"
 	"log"
+	"math/rand"
 	"net"
 	"os"
 	"os/exec"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 	"unsafe"
@@ -30,21 +32,27 @@ const (
 var (
 	ChesstermBinary string
 	LogPath         string
+	DataPath        string
 	SshPort         = ":2222"
+	ReconnectGrace  = time.Minute     // how long the seat of a disconnected player is kept
+	NoShowTimeout   = 3 * time.Minute // for the players of a paired game to show up and make the first move
 )
 
 type Server struct {
 	*ssh.Server
-	Matches map[string]*Match
-	Clients []net.Conn
-	Engine  *uci.Engine
-	In      chan MessageInterface
-	Out     chan MessageInterface
-}
-
-type ServerConn struct {
-	Conn net.Conn
-	Name string
+	Matches        *MatchRegistry
+	Clients        []net.Conn
+	Engines        *EnginePool
+	Archive        *Archive
+	Accounts       *Accounts
+	Matchmaker     *Matchmaker
+	Tournaments    *TournamentManager
+	Arenas         *ArenaManager
+	Correspondence *Correspondence
+	In             chan MessageInterface
+	Out            chan MessageInterface
+	analyzing      sync.Map // ids of the archived games the engine is looking at
+	lobby          sync.Map // connections in the lobby, told when the server goes down
 }
 
 func setWinsize(f *os.File, w, h int) {
@@ -52,21 +60,39 @@ func setWinsize(f *os.File, w, h int) {
 		uintptr(unsafe.Pointer(&struct{ h, w, x, y uint16 }{uint16(h), uint16(w), 0, 0})))
 }
 
-func sshHandle(s ssh.Session) {
-	ptyReq, winCh, isPty := s.Pty()
+func (s *Server) sshHandle(sess ssh.Session) {
+	if len(sess.Command()) > 0 {
+		s.execCommand(sess)
+		return
+	}
+	ptyReq, winCh, isPty := sess.Pty()
 	if !isPty {
-		io.WriteString(s, "non-interactive terminals are not supported\n")
+		io.WriteString(sess, "non-interactive terminals are not supported, try a command:\n"+execUsage)
 
-		s.Exit(1)
+		sess.Exit(1)
 		return
 	}
+	if SpawnChessterm {
+		spawnChessterm(sess, ptyReq, winCh)
+		return
+	}
+	s.runTUI(sess, ptyReq, winCh)
+}
 
+// spawnChessterm runs the chessterm binary in a pty for the session, it connects to the server like any client
+func spawnChessterm(s ssh.Session, ptyReq ssh.Pty, winCh <-chan ssh.Window) {
 	cmdCtx, cancelCmd := context.WithCancel(s.Context())
 	defer cancelCmd()
 
 	cmd := exec.CommandContext(cmdCtx, ChesstermBinary, "-log", LogPath)
 
 	cmd.Env = append(s.Environ(), fmt.Sprintf("TERM=%s", ptyReq.Term))
+	if key := s.PublicKey(); key != nil {
+		fingerprint := gossh.FingerprintSHA256(key)
+		cmd.Env = append(cmd.Env,
+			fmt.Sprintf("%s=%s", EnvIdentity, fingerprint),
+			fmt.Sprintf("%s=%s", EnvIdentityToken, IdentityToken(fingerprint)))
+	}
 
 	f, err := pty.Start(cmd)
 	if err != nil {
@@ -92,14 +118,22 @@ func sshHandle(s ssh.Session) {
 
 }
 
-func NewServer(binary string, sshPort string, logPath string) *Server {
+func NewServer(binary string, sshPort string, logPath string, dataPath string) *Server {
 	SshPort = sshPort
 	ChesstermBinary = binary // path to chess term to open it
 	LogPath = logPath
+	DataPath = dataPath
 	s := &ssh.Server{
 		Addr:        SshPort,
 		IdleTimeout: ServerIdleTimeout,
-		Handler:     sshHandle,
+		// Any key is welcome, it's only used to recognize returning players
+		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool {
+			return true
+		},
+		// Players without a key can still play as guest
+		KeyboardInteractiveHandler: func(ctx ssh.Context, challenger gossh.KeyboardInteractiveChallenge) bool {
+			return true
+		},
 	}
 
 	// TODO: understand what does it do?
@@ -109,183 +143,547 @@ func NewServer(binary string, sshPort string, logPath string) *Server {
 	if err != nil {
 		log.Panic(err)
 	}
-	go func() {
-		err := s.ListenAndServe()
-		if err != nil {
-			panic(err)
-		}
-	}()
 
-	// for single player mode
-	eng, err := uci.New("stockfish")
+	// for single player mode, the built-in engine plays when there is no UCI engine
+	engines, err := NewUCIEnginePool(EngineBinary, EnginePoolSize, EngineQueueTimeout)
+	if err != nil {
+		log.Printf("Failed to start %s, practice games use the built-in engine: %v", EngineBinary, err)
+		engines, _ = NewEnginePool(func() (Searcher, error) {
+			return NewBuiltinEngine(), nil
+		}, EnginePoolSize, EngineQueueTimeout)
+	}
+	archive, err := NewArchive(path.Join(DataPath, ArchiveDir))
 	if err != nil {
-		panic(err)
+		log.Panic(err)
+	}
+	accounts, err := NewAccounts(path.Join(DataPath, AccountsFile))
+	if err != nil {
+		log.Panic(err)
 	}
+
 	in := make(chan MessageInterface, MessageQueueSize)
 	out := make(chan MessageInterface, MessageQueueSize)
 
-	matches := make(map[string]*Match)
 	clients := make([]net.Conn, 0)
 	server := &Server{
-		Server:  s,
-		Matches: matches,
-		Clients: clients,
-		Engine:  eng,
-		In:      in,
-		Out:     out,
+		Server:   s,
+		Matches:  NewMatchRegistry(),
+		Clients:  clients,
+		Engines:  engines,
+		Archive:  archive,
+		Accounts: accounts,
+		In:       in,
+		Out:      out,
+	}
+
+	server.Matchmaker = NewMatchmaker(server)
+	server.Tournaments = NewTournamentManager(server)
+	server.Arenas = NewArenaManager(server)
+	server.Correspondence, err = NewCorrespondence(server, path.Join(DataPath, CorrespondenceFile))
+	if err != nil {
+		log.Panic(err)
 	}
+	if err := server.RestoreMatches(path.Join(DataPath, SnapshotFile)); err != nil {
+		log.Printf("Failed to restore the games in progress: %v", err)
+	}
+	go server.Matchmaker.Run()
+	go server.Correspondence.Run()
+
+	s.Handler = server.sshHandle
+	go func() {
+		err := s.ListenAndServe()
+		if err != nil && err != ssh.ErrServerClosed {
+			panic(err)
+		}
+	}()
 
 	return server
 }
 
-func (s *Server) AddConn(conn net.Conn, matchId, name string, duration, increment int) {
-	if name == "" {
-		name = randomdata.SillyName()
+// AddConn joins the match. False when the match closed in the meantime
+func (s *Server) AddConn(sconn *ServerConn, m *Match) bool {
+	if sconn.Name == "" {
+		sconn.Name = s.GuestName()
 	}
-	if m, ok := s.Matches[matchId]; ok {
-		m.AddConn(conn, name)
-		return
+	return m.AddConn(sconn)
+}
+
+// createMatch registers a match made by newMatch under a random name
+func (s *Server) createMatch(newMatch func(name string) *Match) *Match {
+	for {
+		name := s.NewMatchName()
+		if m, created := s.Matches.Create(name, func() *Match { return newMatch(name) }); created {
+			return m
+		}
 	}
-	s.Matches[matchId] = NewMatch(matchId, false, duration, increment)
-	s.Matches[matchId].AddConn(conn, name)
 }
 
-func (s *Server) HandleConn(sconn ServerConn) {
-	out := make(chan MessageInterface)
-	go func() {
-		for {
-			for message := range out {
-				messageData := Encode(message)
-				messageTransport := &MessageTransport{MsgType: message.Type(), Data: messageData}
-				b := Encode(messageTransport)
-				if b[len(b)-1] != '\n' { // EOF
-					b = append(b, '\n')
-				}
-				if _, err := sconn.Conn.Write(b); err != nil {
-					log.Printf("Failed to write: %v Error: %v", message, err)
+// createNamedMatch registers a match made by newMatch under name, or name-2, name-3... while it's taken
+func (s *Server) createNamedMatch(name string, newMatch func(name string) *Match) *Match {
+	for i := 1; ; i++ {
+		candidate := name
+		if i > 1 {
+			candidate = fmt.Sprintf("%s-%d", name, i)
+		}
+		if m, created := s.Matches.Create(candidate, func() *Match { return newMatch(candidate) }); created {
+			return m
+		}
+	}
+}
+
+// GuestName returns a random name that doesn't belong to any account
+func (s *Server) GuestName() string {
+	for {
+		name := strings.ToLower(randomdata.SillyName())
+		if !s.Accounts.IsNameReserved(name, "") {
+			return name
+		}
+	}
+}
+
+// HandleConn runs the lobby of a client until it joins a match
+func (s *Server) HandleConn(sconn *ServerConn) {
+	// A client who went to a match isn't seeking anymore
+	defer s.Matchmaker.Cancel(sconn)
+	s.lobby.Store(sconn, true)
+	defer s.lobby.Delete(sconn)
+
+	for {
+		var messageTransport MessageTransport
+		select {
+		case assignment := <-sconn.Assign: // Matchmaker or tournament found us an opponent
+			// The seat could have been offered while the client was busy in another match
+			m, seated := assignment.Match, false
+			m.Do(func() {
+				if _, taken := m.Players[int(assignment.Role)]; !taken && !m.Over() {
+					m.addConnAs(sconn, assignment.Role)
+					seated = true
 				}
+			})
+			if seated {
+				return
+			}
+
+		case message, ok := <-sconn.In:
+			if !ok { // Disconnected
+				return
 			}
+			messageTransport = message
 		}
-	}()
 
-	scanner := bufio.NewScanner(sconn.Conn)
-	var messageTransport MessageTransport
-	for scanner.Scan() {
-		Decode(scanner.Bytes(), &messageTransport)
 		switch messageTransport.MsgType {
 		case TypeMessageGameCommand:
 			var message MessageGameCommand
-			Decode(messageTransport.Data, &message)
+			messageTransport.Decode(&message)
 			switch message.Command {
 
 			case CommandPractice:
-				var level int
-				matchId := s.NewMatchName()
-				if len(message.Argument) > 0 {
-					level, _ = strconv.Atoi(message.Argument[0])
-				} else {
-					level = 2
+				// practice (level or Elo) (white|black|random) (time control), in any order
+				level, elo := 2, 0
+				engineRole := Black
+				var tc TimeControl
+				for _, arg := range message.Argument {
+					if n, err := strconv.Atoi(arg); err == nil {
+						if n >= PracticeEloMin {
+							level, elo = 0, n
+							if elo > PracticeEloMax {
+								elo = PracticeEloMax
+							}
+						} else {
+							level = PracticeLimits(n).Level
+						}
+						continue
+					}
+					switch arg {
+					case "white":
+						engineRole = Black
+					case "black":
+						engineRole = White
+					case "random":
+						engineRole = PlayerRole(rand.Intn(2))
+					default:
+						if control, err := ParseTimeControl(arg); err == nil {
+							tc = control
+						}
+					}
 				}
 				if sconn.Name == "" {
-					sconn.Name = randomdata.SillyName()
+					sconn.Name = s.GuestName()
 				}
 
-				s.Matches[matchId] = NewMatch(matchId, true, 30, 0)
-				s.Matches[matchId].Engine = s.Engine
-				s.Matches[matchId].AddConn(sconn.Conn, sconn.Name)
-				s.Matches[matchId].PracticeLevel = level
+				m := s.createMatch(func(name string) *Match {
+					var m *Match
+					if len(tc.Periods) > 0 {
+						m = NewMatchWithControl(s, name, true, tc)
+						m.EngineClock = true
+					} else {
+						m = NewMatch(s, name, true, 30, 0)
+					}
+					m.Engines = s.Engines
+					m.PracticeLevel = level
+					m.PracticeElo = elo
+					m.EngineRole = engineRole
+					return m
+				})
+				m.AddConn(sconn)
 				return
 
 			case CommandCreate:
 				var matchName string
 				duration := 10 // default 10 minutes
 				increment := 0 // default is 0 second
+				if acc := s.Accounts.Get(sconn.Identity); acc != nil {
+					duration, _ = strconv.Atoi(acc.Preference("duration"))
+					increment, _ = strconv.Atoi(acc.Preference("increment"))
+				}
 				if len(message.Argument) > 0 {
 					matchName = message.Argument[0]
 				} else {
 					matchName = s.NewMatchName()
 				}
 
-				if len(message.Argument) > 1 {
+				tc := NewTimeControl(duration, increment)
+				if len(message.Argument) > 2 { // create (code) (duration) (increment)
 					duration, _ = strconv.Atoi(message.Argument[1])
-				}
-
-				if len(message.Argument) > 2 {
 					increment, _ = strconv.Atoi(message.Argument[2])
+					tc = NewTimeControl(duration, increment)
+				} else if len(message.Argument) > 1 { // create (code) (time control)
+					var err error
+					if tc, err = ParseTimeControl(message.Argument[1]); err != nil {
+						sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{fmt.Sprintf("Time control [red]%s[white] not understood. Try [green]10+5[white], [green]5d3[white], [green]5b3[white] or [green]40/5400:1800+30[white]", message.Argument[1])}})
+						continue
+					}
 				}
 
 				matchName = strings.ToLower(strings.TrimSpace(matchName))
-				if !s.IsMatchExisted(matchName) {
-					s.AddConn(sconn.Conn, matchName, sconn.Name, duration, increment)
+				m, created := s.Matches.Create(matchName, func() *Match {
+					return NewMatchWithControl(s, matchName, false, tc)
+				})
+				if created && s.AddConn(sconn, m) {
 					return
 				} else {
 					matchName = s.NewMatchName()
-					out <- MessageGameCommand{Command: CommandMessage, Argument: []string{fmt.Sprintf("Name existed! How about name it: %s?", matchName)}}
+					sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{fmt.Sprintf("Name existed! How about name it: %s?", matchName)}})
 				}
 
 			case CommandJoin:
 				var matchName string
-				matchName = message.Argument[0]
+				if len(message.Argument) > 0 {
+					matchName = message.Argument[0]
+				}
 
-				//if matchName == "" { // join random
-				if len(message.Argument) == 0 { // join random
-					for matchId, match := range s.Matches {
-						if len(match.Players) < 2 && !match.PracticeMode {
-							s.AddConn(sconn.Conn, matchId, sconn.Name, -1, 0)
-							return
-						}
-					}
-					out <- MessageGameCommand{Command: CommandMessage, Argument: []string{"No match available! Create one and invite your friend ^^!"}}
+				if matchName == "" { // join random
+					s.Seek(sconn, &Seek{Duration: SeekDefaultDuration, Increment: SeekDefaultIncrement})
 
-				} else if s.IsMatchExisted(message.Argument[0]) {
-					s.AddConn(sconn.Conn, message.Argument[0], sconn.Name, -1, 0)
+				} else if m, ok := s.Matches.Get(matchName); ok && s.AddConn(sconn, m) {
 					return
 				} else {
-					out <- MessageGameCommand{Command: CommandMessage, Argument: []string{fmt.Sprintf("Match name %s not existed! type [green]create %s[white] to create one!", matchName, matchName)}}
+					sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{fmt.Sprintf("Match name %s not existed! type [green]create %s[white] to create one!", matchName, matchName)}})
 				}
+
+			case CommandTournament:
+				s.HandleTournamentCommand(sconn, message.Argument)
+
+			case CommandArena:
+				s.HandleArenaCommand(sconn, message.Argument)
+
+			case CommandCorrespondence:
+				s.HandleCorrespondenceCommand(sconn, message.Argument)
+
+			case CommandAnalyze:
+				if len(message.Argument) == 0 || message.Argument[0] == "" {
+					sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{"Which game? Type [green]analyze (id)[white], the ids are in [green]history[white]"}})
+					continue
+				}
+				id := message.Argument[0]
+				sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{fmt.Sprintf("Analyzing game [red]%s[white], it takes a moment...", id)}})
+				s.AnalyzeRecord(id, func(record *GameRecord, err error) {
+					// The client may have moved on meanwhile, don't wait on it
+					if err != nil {
+						sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{fmt.Sprintf("Failed to analyze game [red]%s[white]: %v", id, err)}})
+						return
+					}
+					sconn.Send(record.Message())
+				})
+
+			case CommandSeek:
+				if len(message.Argument) > 0 && message.Argument[0] == "cancel" {
+					if s.Matchmaker.Cancel(sconn) {
+						sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{"Stopped seeking"}})
+					} else {
+						sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{"You are not seeking"}})
+					}
+					continue
+				}
+
+				seek := &Seek{Duration: SeekDefaultDuration, Increment: SeekDefaultIncrement}
+				if len(message.Argument) > 0 {
+					seek.Duration, _ = strconv.Atoi(message.Argument[0])
+				}
+				if len(message.Argument) > 1 {
+					seek.Increment, _ = strconv.Atoi(message.Argument[1])
+				}
+				if len(message.Argument) > 2 {
+					seek.Rated = message.Argument[2] == "rated"
+				}
+				if seek.Duration <= 0 || seek.Increment < 0 {
+					sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{"Usage: [green]seek (duration) (increment) [rated][white]"}})
+					continue
+				}
+				if seek.Rated && sconn.Identity == "" {
+					sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{"Rated games need an account, log in with an ssh key!"}})
+					continue
+				}
+				s.Seek(sconn, seek)
+
 			case CommandCallme:
-				sconn.Name = message.Argument[0]
-				out <- MessageGameCommand{Command: CommandMessage, Argument: []string{fmt.Sprintf("[green]%s[white] it is!", strings.Title(sconn.Name))}}
+				if len(message.Argument) == 0 {
+					sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{"Please provide your name after [green]callme[white] command"}})
+					continue
+				}
+				name := strings.ToLower(message.Argument[0])
+				if sconn.Identity != "" {
+					if err := s.Accounts.Rename(sconn.Identity, name); err != nil {
+						sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{fmt.Sprintf("Can't call you [red]%s[white]: %s", name, err)}})
+						continue
+					}
+				} else if !IsValidName(name) {
+					sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{fmt.Sprintf("Can't call you [red]%s[white]: %s", name, ErrInvalidName)}})
+					continue
+				} else if s.Accounts.IsNameReserved(name, "") {
+					sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{fmt.Sprintf("[red]%s[white] is a registered player. Log in with an ssh key to get your own name!", strings.Title(name))}})
+					continue
+				}
+				sconn.Name = name
+				sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{fmt.Sprintf("[green]%s[white] it is!", strings.Title(sconn.Name))}})
+
+			case CommandLeaderboard:
+				speeds := Speeds
+				if len(message.Argument) > 0 && message.Argument[0] != "" {
+					speed, ok := ParseSpeed(message.Argument[0])
+					if !ok {
+						sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{fmt.Sprintf("Unknown speed [red]%s[white]. Try one of: bullet, blitz, rapid, classical", message.Argument[0])}})
+						continue
+					}
+					speeds = []Speed{speed}
+				}
+				sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{s.LeaderboardString(speeds)}})
+
+			case CommandSet:
+				acc := s.Accounts.Get(sconn.Identity)
+				if acc == nil {
+					sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{"Preferences are only saved for players logged in with an ssh key"}})
+					continue
+				}
+				if len(message.Argument) < 2 {
+					keys := make([]string, 0, len(PreferenceDefaults))
+					for key := range PreferenceDefaults {
+						keys = append(keys, key)
+					}
+					sort.Strings(keys)
+					prefString := "Your preferences:\n"
+					for _, key := range keys {
+						prefString += fmt.Sprintf("[green]%s[white]: %s\n", key, acc.Preference(key))
+					}
+					sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{prefString}})
+					continue
+				}
+				if err := s.Accounts.SetPreference(sconn.Identity, message.Argument[0], message.Argument[1]); err != nil {
+					sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{fmt.Sprintf("Can't set [red]%s[white]: %s", message.Argument[0], err)}})
+					continue
+				}
+				sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{fmt.Sprintf("[green]%s[white] is now %s", message.Argument[0], message.Argument[1])}})
 
 			case CommandLs:
 				listMatchString := "Matches list:\n"
-				for matchName, match := range s.Matches {
+				matches := s.Matches.Snapshot()
+				for _, match := range matches {
 					player_count := 0
 					viewer_count := 0
-					for _, p := range match.Players {
-						if p.Role == White || p.Role == Black {
-							player_count++
-						} else {
-							viewer_count++
+					var players []string
+					match.Do(func() {
+						for _, p := range match.Players {
+							if p.Role == White || p.Role == Black {
+								player_count++
+								players = append(players, match.displayName(p))
+							} else {
+								viewer_count++
+							}
 						}
-					}
-					listMatchString += fmt.Sprintf("Match: [red]%s[white] (#Player: %d/2, #Viewer: %d)\n", matchName, player_count, viewer_count)
+					})
+					listMatchString += fmt.Sprintf("Match: [red]%s[white] (#Player: %d/2, #Viewer: %d) %s %s %s\n", match.Name, player_count, viewer_count, match.Control, match.Speed(), strings.Join(players, " vs "))
 				}
-				if len(s.Matches) == 0 {
+				if len(matches) == 0 {
 					listMatchString = "No match found :( Let's create one 🌝"
 				}
+				if seeking := s.Matchmaker.Count(); seeking > 0 {
+					listMatchString += fmt.Sprintf("\n%d player(s) seeking a game", seeking)
+				}
 
-				out <- MessageGameCommand{Command: CommandMessage, Argument: []string{listMatchString}}
+				sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{listMatchString}})
+
+			case CommandHistory:
+				if len(message.Argument) > 0 && message.Argument[0] != "" {
+					record, err := s.Archive.Load(message.Argument[0])
+					if err != nil {
+						sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{fmt.Sprintf("Game [red]%s[white] not found!", message.Argument[0])}})
+						continue
+					}
+					sconn.Send(record.Message())
+					continue
+				}
+
+				records, err := s.Archive.List()
+				if err != nil {
+					log.Printf("Failed to list archive: %v", err)
+				}
+				historyString := "Past games:\n"
+				// Players with an account see their own games
+				if acc := s.Accounts.Get(sconn.Identity); acc != nil && (len(message.Argument) == 0 || message.Argument[0] != "all") {
+					ownGames := make(map[string]bool)
+					for _, id := range acc.Games {
+						ownGames[id] = true
+					}
+					var own []*GameRecord
+					for _, record := range records {
+						if ownGames[record.Id] {
+							own = append(own, record)
+						}
+					}
+					records = own
+					historyString = "Your past games ([green]history all[white] to see everyone's):\n"
+				}
+				for i, record := range records {
+					if i >= ArchiveListLimit {
+						break
+					}
+					hints := ""
+					if n := record.WhiteHints + record.BlackHints; n > 0 {
+						hints = fmt.Sprintf(", %d hints", n)
+					}
+					if record.Analysis != nil {
+						hints += ", analyzed"
+					}
+					historyString += fmt.Sprintf("[red]%s[white] %s vs %s (%s, %s%s)\n", record.Id, record.White, record.Black, record.Result, record.Termination, hints)
+				}
+				if len(records) == 0 {
+					historyString = "No game played yet. Go make some history!"
+				} else {
+					historyString += "Type [green]history (id)[white] to review a game, [green]analyze (id)[white] to have the engine look at it"
+				}
+				sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{historyString}})
 
 			default:
 				log.Println("Unknown command")
 			}
+		case TypeMessageIdentify:
+			var message MessageIdentify
+			messageTransport.Decode(&message)
+			if !VerifyIdentity(message.Identity, message.Token) {
+				log.Printf("Rejected identity: %s", message.Identity)
+				continue
+			}
+			name := sconn.Name
+			if name == "" {
+				name = s.GuestName()
+			}
+			acc, err := s.Accounts.Login(message.Identity, name)
+			if err != nil {
+				log.Printf("Failed to log in %s: %v", message.Identity, err)
+				continue
+			}
+			sconn.Identity = acc.Fingerprint
+			sconn.Name = acc.Name
+			sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{fmt.Sprintf("Welcome [green]%s[white]! Your name is kept for your ssh key, change it with [green]callme[white]", strings.Title(acc.Name))}})
+			waiting, challenges := 0, 0
+			for _, g := range s.Correspondence.Inbox(acc.Fingerprint) {
+				if g.IsTurn(acc.Fingerprint) {
+					waiting++
+				} else if g.Pending() && g.Challenger != acc.Fingerprint {
+					challenges++
+				}
+			}
+			if waiting > 0 {
+				sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{fmt.Sprintf("[red]%d[white] correspondence games are waiting for your move, type [green]corr[white] to see them", waiting)}})
+			}
+			if challenges > 0 {
+				sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{fmt.Sprintf("[red]%d[white] correspondence challenges are waiting for your answer, type [green]corr[white] to see them", challenges)}})
+			}
+
+			// Back from a dropped ssh session in the middle of a game
+			for _, m := range s.Matches.Snapshot() {
+				if role, ok := m.HeldSeatOf(sconn.Identity); ok {
+					sconn.AssignSeat(Assignment{Match: m, Role: role})
+					break
+				}
+			}
+
+		case TypeMessageReconnect:
+			var message MessageReconnect
+			messageTransport.Decode(&message)
+			m, ok := s.Matches.Get(message.Match)
+			seated := false
+			if ok {
+				m.Do(func() {
+					for role, token := range m.Sessions {
+						if _, held := m.Held[role]; held && token == message.Token && !m.Over() {
+							m.addConnAs(sconn, role)
+							seated = true
+							return
+						}
+					}
+				})
+			}
+			if seated {
+				return
+			}
+			sconn.Send(MessageGameStatus{Message: "Your game is over, exit to go back to the menu"})
+
 		default:
 			log.Printf("Unknown message type: %v", messageTransport.MsgType)
 		}
 	}
 }
 
-func (s *Server) IsMatchExisted(name string) bool {
-	_, ok := s.Matches[name]
-	return ok
+func (s *Server) Seek(sconn *ServerConn, seek *Seek) {
+	if sconn.Name == "" {
+		sconn.Name = s.GuestName()
+	}
+	seek.Conn = sconn
+	seek.Rating = RatingDefault
+	if acc := s.Accounts.Get(sconn.Identity); acc != nil {
+		seek.Rating = acc.Rating(seek.Speed()).Rating
+	}
+	s.Matchmaker.Add(seek)
+
+	rated := "casual"
+	if seek.Rated {
+		rated = "rated"
+	}
+	sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{fmt.Sprintf("Seeking a %s %d+%d game... type [green]seek cancel[white] to stop", rated, seek.Duration, seek.Increment)}})
+}
+
+func (s *Server) LeaderboardString(speeds []Speed) string {
+	leaderboard := "Leaderboard:\n"
+	for _, speed := range speeds {
+		leaderboard += fmt.Sprintf("[yellow]%s[white]\n", strings.Title(string(speed)))
+		accounts := s.Accounts.Leaderboard(speed, LeaderboardLimit)
+		if len(accounts) == 0 {
+			leaderboard += "  No rated game yet\n"
+		}
+		for i, acc := range accounts {
+			rating := acc.Rating(speed)
+			leaderboard += fmt.Sprintf("%2d. [green]%-20s[white] %6s (%d games)\n", i+1, strings.Title(acc.Name), rating, rating.Games)
+		}
+	}
+	return leaderboard
 }
 
 func (s *Server) NewMatchName() string {
 	// TODO there might be a case when we ran out of countries name, but I'm afraid so lol
 	for {
 		matchName := randomdata.Country(randomdata.FullCountry)
-		if !s.IsMatchExisted(matchName) {
+		if !s.Matches.Has(matchName) {
 			return matchName
 		}
 	}
@@ -294,17 +692,23 @@ func (s *Server) NewMatchName() string {
 func (s *Server) CleanIdleMatches() {
 	tick := time.NewTicker(1 * time.Minute)
 	for {
-		connection_count := 0
 		select {
 		case <-tick.C:
-			for key, m := range s.Matches {
-				connection_count += len(m.Players)
-				if len(m.Players) == 0 {
-					delete(s.Matches, key)
-					log.Printf("Deleted match: %s", key)
-				}
-			}
-			log.Printf("Connection count: %d", connection_count)
+			s.closeIdleMatches()
+		}
+	}
+}
+
+func (s *Server) closeIdleMatches() {
+	connection_count := 0
+	for _, m := range s.Matches.Snapshot() {
+		m.Do(func() {
+			connection_count += len(m.Players)
+		})
+		if m.CloseIfIdle() {
+			s.Matches.Delete(m)
+			log.Printf("Deleted match: %s", m.Name)
 		}
 	}
+	log.Printf("Connection count: %d", connection_count)
 }
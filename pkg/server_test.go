@@ -0,0 +1,97 @@
+package pkg
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer is a server without the ssh part, its files are in dir
+func newTestServer(t testing.TB, dir string) *Server {
+	engines, err := NewEnginePool(func() (Searcher, error) {
+		return NewBuiltinEngine(), nil
+	}, 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := NewArchive(filepath.Join(dir, ArchiveDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounts, err := NewAccounts(filepath.Join(dir, AccountsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Matches:  NewMatchRegistry(),
+		Engines:  engines,
+		Archive:  archive,
+		Accounts: accounts,
+	}
+	s.Matchmaker = NewMatchmaker(s)
+	s.Tournaments = NewTournamentManager(s)
+	s.Arenas = NewArenaManager(s)
+	if s.Correspondence, err = NewCorrespondence(s, filepath.Join(dir, CorrespondenceFile)); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// Messages a client could send, arguments are split on commas so they can be empty
+func fuzzClientMessage(kind uint8, word, args string) MessageInterface {
+	var argument []string
+	if args != "" {
+		argument = strings.Split(args, ",")
+	}
+	switch kind % 5 {
+	case 0:
+		return MessageMove{Move: word}
+	case 1:
+		return MessageGameAction{Action: Action(word)}
+	case 2:
+		return MessageGameCommand{Command: Command(word), Argument: argument}
+	case 3:
+		return MessageGameChat{Message: args}
+	default:
+		return MessageReconnect{Match: word, Token: args}
+	}
+}
+
+func fuzzMessageSeeds(f *testing.F) {
+	for _, action := range []Action{ActionDrawOffer, ActionDrawAccept, ActionDrawReject, ActionResignYes, ActionResignNo,
+		ActionNewGameOffer, ActionNewGameAccept, ActionNewGameReject, ActionExit, ActionTimeOut, ActionBerserk,
+		ActionHint, ActionEval, ActionAnalyze, ActionWin, "", "Nope"} {
+		f.Add(uint8(1), string(action), "", 0)
+	}
+	for _, command := range []Command{CommandLs, CommandCreate, CommandJoin, CommandCallme, CommandMessage, CommandPractice,
+		CommandHistory, CommandSet, CommandLeaderboard, CommandSeek, CommandTournament, CommandArena, CommandCorrespondence,
+		CommandAnalyze, "", "nope"} {
+		f.Add(uint8(2), string(command), "", 0)
+		f.Add(uint8(2), string(command), ",", 1)
+		f.Add(uint8(2), string(command), "x,10,5", 1)
+	}
+	f.Add(uint8(0), "e2e4", "", 0) // Before the game started
+	f.Add(uint8(0), "e7e5", "", 1)
+	f.Add(uint8(0), "", "", -1)
+	f.Add(uint8(3), "", "hello", 100)
+	f.Add(uint8(4), "match", "token", 0)
+}
+
+func FuzzHandleConn(f *testing.F) {
+	fuzzMessageSeeds(f)
+	s := newTestServer(f, f.TempDir())
+	defer s.Engines.Close()
+	f.Fuzz(func(t *testing.T, kind uint8, word, args string, _ int) {
+		defer closeAll(s.Matches)
+		sconn := NewLocalServerConn()
+		defer sconn.Close()
+		go s.HandleConn(sconn)
+		// The lobby reads the next message once it's done with the one before
+		for _, message := range []MessageInterface{fuzzClientMessage(kind, word, args), MessageGameChat{}, MessageGameChat{}} {
+			if !sconn.Deliver(message) {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,231 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/notnil/chess"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+const SnapshotFile = "matches.json"
+
+var (
+	RestoreGrace  = 10 * time.Minute // how long a game saved at shutdown waits for its players
+	ShutdownFlush = 2 * time.Second  // for the last messages to reach the clients before they are disconnected
+)
+
+// A game in progress saved at shutdown, the players take their seats back after the restart
+type MatchSnapshot struct {
+	Name          string
+	Control       TimeControl
+	Fen           string // to check the moves replay to the same position
+	Moves         []string
+	MoveClocks    []time.Duration
+	WhiteClock    *Clock
+	BlackClock    *Clock
+	StartedAt     time.Time
+	Rated         bool
+	PracticeMode  bool
+	PracticeLevel int
+	PracticeElo   int
+	EngineRole    PlayerRole
+	EngineClock   bool
+	AllowBerserk  bool
+	Berserked     map[PlayerRole]bool
+	Hints         map[PlayerRole]int
+	Sessions      map[PlayerRole]string
+	Seats         map[PlayerRole]string
+	Players       map[PlayerRole]SeatSnapshot
+}
+
+// Who sat on a seat, to recognize them when they come back
+type SeatSnapshot struct {
+	Name     string
+	Identity string
+}
+
+// snapshot pauses the clocks and keeps what's needed to restore the match. Nil when no game is going on.
+// The match is suspended, moves arriving before it's closed would be lost
+func (m *Match) snapshot() *MatchSnapshot {
+	m.Suspended = true
+	m.saved = true
+	if m.State != MatchPlaying {
+		return nil
+	}
+	m.Clocks[int(White)].Pause()
+	m.Clocks[int(Black)].Pause()
+	snap := &MatchSnapshot{
+		Name:          m.Name,
+		Control:       m.Control,
+		Fen:           m.GameFEN(),
+		Moves:         m.GameMoves(),
+		MoveClocks:    m.MoveClocks,
+		WhiteClock:    m.Clocks[int(White)].Snapshot(),
+		BlackClock:    m.Clocks[int(Black)].Snapshot(),
+		StartedAt:     m.StartedAt,
+		Rated:         m.Rated,
+		PracticeMode:  m.PracticeMode,
+		PracticeLevel: m.PracticeLevel,
+		PracticeElo:   m.PracticeElo,
+		EngineRole:    m.EngineRole,
+		EngineClock:   m.EngineClock,
+		AllowBerserk:  m.AllowBerserk,
+		Berserked:     m.Berserked,
+		Hints:         m.Hints,
+		Sessions:      m.Sessions,
+		Seats:         m.Seats,
+		Players:       make(map[PlayerRole]SeatSnapshot),
+	}
+	for _, role := range []PlayerRole{White, Black} {
+		p, ok := m.Players[int(role)]
+		if held, dropped := m.Held[role]; dropped {
+			p, ok = held.Player, true
+		}
+		if ok {
+			snap.Players[role] = SeatSnapshot{Name: p.Name, Identity: p.Identity}
+		}
+	}
+	return snap
+}
+
+// restoreMatch registers the game again with the clocks stopped and the seats held for the players.
+// It takes another name if the saved one is taken
+func restoreMatch(s *Server, snap *MatchSnapshot) (*Match, error) {
+	game, err := GameFromMoves(snap.Moves)
+	if err != nil {
+		return nil, err
+	}
+	if game.Position().String() != snap.Fen {
+		return nil, fmt.Errorf("moves of %s don't lead to %s", snap.Name, snap.Fen)
+	}
+	return s.createNamedMatch(snap.Name, func(name string) *Match {
+		m := NewMatchWithControl(s, name, snap.PracticeMode, snap.Control)
+		m.Game = game
+		m.Turn = White
+		if game.Position().Turn() == chess.Black {
+			m.Turn = Black
+		}
+		m.MoveClocks = snap.MoveClocks
+		for role, clock := range map[PlayerRole]*Clock{White: snap.WhiteClock, Black: snap.BlackClock} {
+			clock.Paused = true
+			m.Clocks[int(role)] = clock
+		}
+		m.StartedAt = snap.StartedAt
+		m.Rated = snap.Rated
+		m.PracticeLevel = snap.PracticeLevel
+		m.PracticeElo = snap.PracticeElo
+		m.EngineRole = snap.EngineRole
+		m.EngineClock = snap.EngineClock
+		m.Engines = s.Engines
+		m.AllowBerserk = snap.AllowBerserk
+		for role, berserked := range snap.Berserked {
+			m.Berserked[role] = berserked
+		}
+		for role, hints := range snap.Hints {
+			m.Hints[role] = hints
+		}
+		for role, token := range snap.Sessions {
+			m.Sessions[role] = token
+		}
+		for role, key := range snap.Seats {
+			m.Seats[role] = key
+		}
+		m.State = MatchPlaying
+		m.Suspended = true
+		m.Do(func() {
+			for role, seat := range snap.Players {
+				p := NewPlayer(&ServerConn{Name: seat.Name, Identity: seat.Identity})
+				p.Role = role
+				m.hold(p, RestoreGrace)
+			}
+		})
+		return m
+	}), nil
+}
+
+// SaveMatches keeps the games in progress in the data directory and closes every match.
+// Players get a word about it before they are disconnected
+func (s *Server) SaveMatches(file string) error {
+	matches := s.Matches.Snapshot()
+	var snaps []*MatchSnapshot
+	for _, m := range matches {
+		m.Do(func() {
+			message := "The server is restarting for maintenance"
+			if snap := m.snapshot(); snap != nil {
+				snaps = append(snaps, snap)
+				message += ", the game is saved with the clocks stopped. Come back in a minute to continue"
+			}
+			for _, p := range m.Players {
+				p.Send(MessageGameStatus{Message: message})
+				p.Send(MessageGameChat{Message: fmt.Sprintf("[red]%s[white]\n", message)})
+			}
+		})
+	}
+	time.Sleep(ShutdownFlush)
+	for _, m := range matches {
+		m.Close()
+	}
+
+	data, err := json.MarshalIndent(snaps, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return err
+	}
+	log.Printf("Saved %d games in progress", len(snaps))
+	return nil
+}
+
+// RestoreMatches brings back the games saved at the last shutdown
+func (s *Server) RestoreMatches(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var snaps []*MatchSnapshot
+	if err := json.Unmarshal(data, &snaps); err != nil {
+		return err
+	}
+	for _, snap := range snaps {
+		m, err := restoreMatch(s, snap)
+		if err != nil {
+			log.Printf("Failed to restore match %s: %v", snap.Name, err)
+			continue
+		}
+		log.Printf("Restored match %s", m.Name)
+	}
+	// Saved once, restored once
+	return os.Remove(file)
+}
+
+// Shutdown takes the server down for maintenance: no new players, everyone is told
+// and the games in progress are saved for the next start
+func (s *Server) Shutdown() {
+	// Only closes the listeners, the sessions end once the games are saved
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Server.Shutdown(ctx)
+
+	s.lobby.Range(func(key, _ interface{}) bool {
+		key.(*ServerConn).Send(MessageGameCommand{Command: CommandMessage, Argument: []string{"[red]The server is restarting for maintenance, come back in a minute[white]"}})
+		return true
+	})
+	if err := s.SaveMatches(path.Join(DataPath, SnapshotFile)); err != nil {
+		log.Printf("Failed to save the games in progress: %v", err)
+	}
+	s.Engines.Close()
+	s.Server.Close()
+	log.Println("Server stopped")
+}
@@ -0,0 +1,171 @@
+package pkg
+
+import (
+	"github.com/gdamore/tcell/v2"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"io"
+	"log"
+	"sync"
+)
+
+// SpawnChessterm runs the chessterm binary for each ssh session instead of the TUI of the server
+var SpawnChessterm = false
+
+// sessionTty is an ssh session as tcell sees a terminal
+type sessionTty struct {
+	ssh.Session
+	input   chan []byte   // read from the session, closed when it ends
+	drained chan struct{} // tcell is done reading
+	pending []byte
+	mu      sync.Mutex
+	width   int
+	height  int
+	resized func()
+}
+
+func newSessionTty(sess ssh.Session, window ssh.Window) *sessionTty {
+	t := &sessionTty{
+		Session: sess,
+		input:   make(chan []byte),
+		drained: make(chan struct{}),
+		width:   window.Width,
+		height:  window.Height,
+	}
+	go t.pump()
+	return t
+}
+
+// pump reads the session so that a read of tcell can be woken up by Drain
+func (t *sessionTty) pump() {
+	defer close(t.input)
+	for {
+		buf := make([]byte, 128)
+		n, err := t.Session.Read(buf)
+		if n > 0 {
+			select {
+			case t.input <- buf[:n]:
+			case <-t.drained:
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// watch follows the size of the window of the client
+func (t *sessionTty) watch(windows <-chan ssh.Window) {
+	for window := range windows {
+		t.mu.Lock()
+		t.width, t.height = window.Width, window.Height
+		resized := t.resized
+		t.mu.Unlock()
+		if resized != nil {
+			resized()
+		}
+	}
+}
+
+func (t *sessionTty) Read(p []byte) (int, error) {
+	if len(t.pending) == 0 {
+		select {
+		case data, ok := <-t.input:
+			if !ok {
+				return 0, io.EOF
+			}
+			t.pending = data
+		case <-t.drained:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, t.pending)
+	t.pending = t.pending[n:]
+	return n, nil
+}
+
+// The client's terminal is already raw, ssh asked for a pty
+func (t *sessionTty) Start() error {
+	return nil
+}
+
+func (t *sessionTty) Stop() error {
+	return nil
+}
+
+func (t *sessionTty) Drain() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case <-t.drained:
+	default:
+		close(t.drained)
+	}
+	return nil
+}
+
+// The session is closed by ssh once the TUI is done, with the exit status
+func (t *sessionTty) Close() error {
+	return t.Drain()
+}
+
+func (t *sessionTty) NotifyResize(cb func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.resized = cb
+}
+
+func (t *sessionTty) WindowSize() (int, int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.width, t.height, nil
+}
+
+// newSessionScreen draws on the session for the terminal type the client asked the pty for
+func newSessionScreen(tty tcell.Tty, term string) (tcell.Screen, error) {
+	ti, err := tcell.LookupTerminfo(term)
+	if err != nil { // Unknown to us, most terminals speak xterm anyway
+		if ti, err = tcell.LookupTerminfo("xterm-256color"); err != nil {
+			return nil, err
+		}
+	}
+	return tcell.NewTerminfoScreenFromTtyTerminfo(tty, ti)
+}
+
+// runTUI draws the client right on the ssh session, it hands its messages to the server through channels
+func (s *Server) runTUI(sess ssh.Session, ptyReq ssh.Pty, windows <-chan ssh.Window) {
+	tty := newSessionTty(sess, ptyReq.Window)
+	go tty.watch(windows)
+	screen, err := newSessionScreen(tty, ptyReq.Term)
+	if err == nil {
+		err = screen.Init() // tview only sets up the screens it makes
+	}
+	if err != nil {
+		io.WriteString(sess, "failed to initialize the terminal: "+err.Error()+"\n")
+		sess.Exit(1)
+		return
+	}
+
+	cl := NewClient()
+	cl.Addr = "in-process"
+	cl.Local = NewLocalServerConn()
+	go s.HandleConn(cl.Local)
+	defer cl.Disconnect()
+	defer cl.recoverPanic()
+	if key := sess.PublicKey(); key != nil {
+		fingerprint := gossh.FingerprintSHA256(key)
+		cl.Identify(fingerprint, IdentityToken(fingerprint))
+	}
+	go cl.HandleRead()
+	go cl.HandleWrite()
+	// The player hung up
+	go func() {
+		<-sess.Context().Done()
+		cl.Disconnect()
+	}()
+
+	if err := cl.App.SetScreen(screen).SetRoot(cl.MenuLayout, true).EnableMouse(true).Run(); err != nil {
+		log.Printf("TUI of %s stopped: %v", sess.User(), err)
+	}
+}
@@ -0,0 +1,149 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type DelayKind int
+
+const (
+	DelayNone      DelayKind = iota // the bonus is a Fischer increment, added after each move
+	DelaySimple                     // the clock waits for the bonus before counting down (US delay)
+	DelayBronstein                  // the time used on a move is given back, up to the bonus
+)
+
+var ErrInvalidTimeControl = errors.New("invalid time control")
+
+// A stage of a time control, e.g: 40 moves in 90 minutes
+type Period struct {
+	Moves    int           // moves to play within the period, 0 for the rest of the game
+	Duration time.Duration // added to the clock when the period starts
+	Bonus    time.Duration // increment or delay of each move
+	Delay    DelayKind
+}
+
+// The periods of a game. When the last period has a number of moves, it's repeated
+type TimeControl struct {
+	Periods []Period
+}
+
+// NewTimeControl is a single period of duration minutes with an increment in seconds
+func NewTimeControl(duration, increment int) TimeControl {
+	return TimeControl{Periods: []Period{{
+		Duration: time.Duration(duration) * time.Minute,
+		Bonus:    time.Duration(increment) * time.Second,
+	}}}
+}
+
+// ParseTimeControl reads a compact time control:
+//
+//	90+30          : 90 minutes with a 30 seconds increment
+//	5d3, 5b3       : 5 minutes with a 3 seconds simple or Bronstein delay
+//	40/5400:1800+30: periods separated by colons, in seconds as in PGN. 40 moves in 90 minutes,
+//	                 then 30 minutes with a 30 seconds increment for the rest of the game
+func ParseTimeControl(s string) (TimeControl, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if !strings.ContainsAny(s, "/:") {
+		period, err := parsePeriod(s, time.Minute)
+		if err != nil {
+			return TimeControl{}, err
+		}
+		return TimeControl{Periods: []Period{period}}, nil
+	}
+
+	var tc TimeControl
+	stages := strings.Split(s, ":")
+	for i, stage := range stages {
+		moves := 0
+		if slash := strings.Index(stage, "/"); slash >= 0 {
+			var err error
+			if moves, err = strconv.Atoi(stage[:slash]); err != nil || moves <= 0 {
+				return TimeControl{}, ErrInvalidTimeControl
+			}
+			stage = stage[slash+1:]
+		} else if i < len(stages)-1 { // Only the last period can last until the end
+			return TimeControl{}, ErrInvalidTimeControl
+		}
+		period, err := parsePeriod(stage, time.Second)
+		if err != nil {
+			return TimeControl{}, err
+		}
+		period.Moves = moves
+		tc.Periods = append(tc.Periods, period)
+	}
+	return tc, nil
+}
+
+// A duration in unit followed by a bonus in seconds: 90+30, 5d3, 5b3 or 10
+func parsePeriod(s string, unit time.Duration) (Period, error) {
+	var period Period
+	base, bonus := s, "0"
+	if i := strings.IndexAny(s, "+db"); i >= 0 {
+		base, bonus = s[:i], s[i+1:]
+		switch s[i] {
+		case 'd':
+			period.Delay = DelaySimple
+		case 'b':
+			period.Delay = DelayBronstein
+		}
+	}
+	duration, err := strconv.Atoi(base)
+	if err != nil || duration <= 0 {
+		return Period{}, ErrInvalidTimeControl
+	}
+	seconds, err := strconv.Atoi(bonus)
+	if err != nil || seconds < 0 {
+		return Period{}, ErrInvalidTimeControl
+	}
+	period.Duration = time.Duration(duration) * unit
+	period.Bonus = time.Duration(seconds) * time.Second
+	return period, nil
+}
+
+func (p Period) bonusString() string {
+	switch p.Delay {
+	case DelaySimple:
+		return fmt.Sprintf("d%d", int(p.Bonus.Seconds()))
+	case DelayBronstein:
+		return fmt.Sprintf("b%d", int(p.Bonus.Seconds()))
+	default:
+		return fmt.Sprintf("+%d", int(p.Bonus.Seconds()))
+	}
+}
+
+// String is the compact form ParseTimeControl reads back
+func (tc TimeControl) String() string {
+	if len(tc.Periods) == 1 && tc.Periods[0].Moves == 0 && tc.Periods[0].Duration%time.Minute == 0 {
+		p := tc.Periods[0]
+		return fmt.Sprintf("%d%s", int(p.Duration.Minutes()), p.bonusString())
+	}
+	return tc.PGN()
+}
+
+// PGN is the TimeControl tag, in seconds. Delays aren't part of the PGN standard, they keep the compact form
+func (tc TimeControl) PGN() string {
+	stages := make([]string, len(tc.Periods))
+	for i, p := range tc.Periods {
+		stage := strconv.Itoa(int(p.Duration.Seconds()))
+		if p.Moves > 0 {
+			stage = fmt.Sprintf("%d/%s", p.Moves, stage)
+		}
+		if p.Bonus > 0 || p.Delay != DelayNone {
+			stage += p.bonusString()
+		}
+		stages[i] = stage
+	}
+	return strings.Join(stages, ":")
+}
+
+// Speed is estimated from the first period
+func (tc TimeControl) Speed() Speed {
+	if len(tc.Periods) == 0 {
+		return SpeedClassical
+	}
+	return SpeedOf(tc.Periods[0].Duration, tc.Periods[0].Bonus)
+}
@@ -0,0 +1,582 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"github.com/notnil/chess"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TournamentKind string
+
+const (
+	TournamentSwiss      TournamentKind = "swiss"
+	TournamentRoundRobin TournamentKind = "roundrobin"
+)
+
+type TournamentState int
+
+const (
+	TournamentRegistering TournamentState = iota
+	TournamentRunning
+	TournamentFinished
+)
+
+func (ts TournamentState) String() string {
+	switch ts {
+	case TournamentRegistering:
+		return "Registering"
+	case TournamentRunning:
+		return "Running"
+	case TournamentFinished:
+		return "Finished"
+	default:
+		return "Unknown"
+	}
+}
+
+const ByeScore = 1.
+
+var (
+	ErrTournamentExisted  = errors.New("tournament name existed")
+	ErrTournamentNotFound = errors.New("tournament not found")
+	ErrTournamentStarted  = errors.New("tournament has already started")
+	ErrTournamentOwner    = errors.New("only the creator can start the tournament")
+	ErrTournamentPlayers  = errors.New("a tournament needs at least 2 players")
+	ErrTournamentJoined   = errors.New("you have already joined")
+)
+
+type TournamentPlayer struct {
+	Key       string // ServerConn.Key
+	Name      string
+	Rating    float64
+	Score     float64
+	Opponents []*TournamentPlayer // nil for a bye
+	Results   []float64
+	Colors    []PlayerRole // Viewer for a bye
+	Byes      int
+	Conn      *ServerConn // last connection of the player, used to send the pairings
+}
+
+// seatKey reserves the seat of the player in its games, see ServerConn.SeatKey
+func (tp *TournamentPlayer) seatKey() string {
+	if tp.Conn != nil {
+		return tp.Conn.SeatKey()
+	}
+	return tp.Key
+}
+
+func (tp *TournamentPlayer) HasPlayed(other *TournamentPlayer) bool {
+	for _, opponent := range tp.Opponents {
+		if opponent == other {
+			return true
+		}
+	}
+	return false
+}
+
+// ColorDifference is the number of games with white minus the number of games with black
+func (tp *TournamentPlayer) ColorDifference() int {
+	diff := 0
+	for _, color := range tp.Colors {
+		if color == White {
+			diff++
+		} else if color == Black {
+			diff--
+		}
+	}
+	return diff
+}
+
+func (tp *TournamentPlayer) LastColor() PlayerRole {
+	for i := len(tp.Colors) - 1; i >= 0; i-- {
+		if tp.Colors[i] != Viewer {
+			return tp.Colors[i]
+		}
+	}
+	return Viewer
+}
+
+// Buchholz is the sum of the scores of the opponents
+func (tp *TournamentPlayer) Buchholz() float64 {
+	sum := 0.
+	for _, opponent := range tp.Opponents {
+		if opponent != nil {
+			sum += opponent.Score
+		}
+	}
+	return sum
+}
+
+// SonnebornBerger is the sum of the scores of the beaten opponents plus half of the drawn ones
+func (tp *TournamentPlayer) SonnebornBerger() float64 {
+	sum := 0.
+	for i, opponent := range tp.Opponents {
+		if opponent != nil {
+			sum += tp.Results[i] * opponent.Score
+		}
+	}
+	return sum
+}
+
+type Tournament struct {
+	Name      string
+	Kind      TournamentKind
+	Owner     string // ServerConn.Key of the creator
+	Duration  int    // minutes
+	Increment int    // seconds
+	Rounds    int
+	Round     int // current round, 1 based
+	State     TournamentState
+	Players   []*TournamentPlayer
+	Pairings  [][]*Pairing // by round
+	Server    *Server
+	mu        sync.Mutex
+	pending   []notice // sent once the lock is released
+}
+
+// A message for a player, sent without holding the lock of the tournament
+type notice struct {
+	conn *ServerConn
+	text string
+}
+
+func (t *Tournament) Join(sconn *ServerConn, rating float64) error {
+	t.mu.Lock()
+	defer t.unlock()
+
+	for _, p := range t.Players {
+		if p.Key == sconn.Key() {
+			p.Conn = sconn
+			return ErrTournamentJoined
+		}
+	}
+	if t.State != TournamentRegistering {
+		return ErrTournamentStarted
+	}
+	t.Players = append(t.Players, &TournamentPlayer{
+		Key:    sconn.Key(),
+		Name:   sconn.Name,
+		Rating: rating,
+		Conn:   sconn,
+	})
+	t.broadcast(fmt.Sprintf("[green]%s[white] joined tournament [red]%s[white] (%d players)", strings.Title(sconn.Name), t.Name, len(t.Players)))
+	return nil
+}
+
+func (t *Tournament) Start(sconn *ServerConn) error {
+	t.mu.Lock()
+	defer t.unlock()
+
+	if t.Owner != sconn.Key() {
+		return ErrTournamentOwner
+	}
+	if t.State != TournamentRegistering {
+		return ErrTournamentStarted
+	}
+	if len(t.Players) < 2 {
+		return ErrTournamentPlayers
+	}
+
+	if t.Kind == TournamentRoundRobin {
+		// Seeds by rating, they're the numbers of the Berger tables
+		sort.SliceStable(t.Players, func(i, j int) bool { return t.Players[i].Rating > t.Players[j].Rating })
+		t.Rounds = RoundRobinRounds(len(t.Players))
+	} else if t.Rounds >= len(t.Players) {
+		t.Rounds = len(t.Players) - 1
+	}
+	t.State = TournamentRunning
+	t.startRound()
+	return nil
+}
+
+// Caller must hold the lock
+func (t *Tournament) startRound() {
+	t.Round++
+	var pairings []*Pairing
+
+	if t.Kind == TournamentRoundRobin {
+		n := len(t.Players)
+		for _, pair := range BergerPairings(n, t.Round-1) {
+			if pair[0] >= n {
+				pairings = append(pairings, &Pairing{White: t.Players[pair[1]]})
+			} else if pair[1] >= n {
+				pairings = append(pairings, &Pairing{White: t.Players[pair[0]]})
+			} else {
+				pairings = append(pairings, &Pairing{White: t.Players[pair[0]], Black: t.Players[pair[1]]})
+			}
+		}
+	} else {
+		pairs, bye := PairSwiss(t.Players)
+		for _, pair := range pairs {
+			pairings = append(pairings, &Pairing{White: pair[0], Black: pair[1]})
+		}
+		if bye != nil {
+			pairings = append(pairings, &Pairing{White: bye})
+		}
+	}
+	t.Pairings = append(t.Pairings, pairings)
+
+	for board, pairing := range pairings {
+		if pairing.Black == nil {
+			pairing.Done = true
+			pairing.Result = ByeScore
+			t.record(pairing)
+			t.send(pairing.White, fmt.Sprintf("Round %d of [red]%s[white]: you have a bye", t.Round, t.Name))
+			continue
+		}
+		pairing.Match = t.createMatch(pairing, board+1)
+	}
+	log.Printf("Tournament %s started round %d", t.Name, t.Round)
+	t.checkRound()
+}
+
+// Caller must hold the lock
+func (t *Tournament) createMatch(pairing *Pairing, board int) *Match {
+	s := t.Server
+	m := s.createNamedMatch(fmt.Sprintf("%s-r%d-b%d", t.Name, t.Round, board), func(name string) *Match {
+		m := NewMatch(s, name, false, t.Duration, t.Increment)
+		m.Seats[White] = pairing.White.seatKey()
+		m.Seats[Black] = pairing.Black.seatKey()
+		// Reported from their own goroutine, the next round shouldn't wait on this match
+		m.OnEnd = func(m *Match, outcome chess.Outcome) {
+			go t.Report(pairing, outcome)
+		}
+		m.OnAbort = func(m *Match) {
+			go t.Report(pairing, chess.NoOutcome)
+		}
+		return m
+	})
+	m.ExpectPlayers(NoShowTimeout)
+
+	for role, p := range map[PlayerRole]*TournamentPlayer{White: pairing.White, Black: pairing.Black} {
+		opponent := pairing.Black
+		if role == Black {
+			opponent = pairing.White
+		}
+		t.send(p, fmt.Sprintf("Round %d of [red]%s[white]: you play %s against [green]%s[white]. Type [green]join %s[white] if you're not taken there", t.Round, t.Name, role, strings.Title(opponent.Name), m.Name))
+		if p.Conn != nil {
+			p.Conn.AssignSeat(Assignment{Match: m, Role: role})
+		}
+	}
+	return m
+}
+
+// Report records the outcome of a tournament game, the next round starts once all games are over.
+// A game closed without a result is lost by both players
+func (t *Tournament) Report(pairing *Pairing, outcome chess.Outcome) {
+	t.mu.Lock()
+	defer t.unlock()
+
+	if pairing.Done {
+		return
+	}
+	switch outcome {
+	case chess.WhiteWon:
+		pairing.Result = 1
+	case chess.BlackWon:
+		pairing.Result = 0
+	case chess.Draw:
+		pairing.Result = 0.5
+	default:
+		pairing.Result = 0
+		pairing.Forfeited = true
+		for _, p := range []*TournamentPlayer{pairing.White, pairing.Black} {
+			t.send(p, fmt.Sprintf("Round %d of [red]%s[white]: the game in %s was closed without a result, both players lose it", t.Round, t.Name, pairing.Match.Name))
+		}
+	}
+	pairing.Done = true
+	t.record(pairing)
+	t.checkRound()
+}
+
+// Caller must hold the lock
+func (t *Tournament) record(pairing *Pairing) {
+	white := pairing.White
+	white.Score += pairing.Result
+	white.Results = append(white.Results, pairing.Result)
+	if pairing.Black == nil {
+		white.Opponents = append(white.Opponents, nil)
+		white.Colors = append(white.Colors, Viewer)
+		white.Byes++
+		return
+	}
+	white.Opponents = append(white.Opponents, pairing.Black)
+	white.Colors = append(white.Colors, White)
+
+	black := pairing.Black
+	result := 1 - pairing.Result
+	if pairing.Forfeited {
+		result = 0
+	}
+	black.Score += result
+	black.Results = append(black.Results, result)
+	black.Opponents = append(black.Opponents, white)
+	black.Colors = append(black.Colors, Black)
+}
+
+// Caller must hold the lock
+func (t *Tournament) checkRound() {
+	for _, pairing := range t.Pairings[t.Round-1] {
+		if !pairing.Done {
+			return
+		}
+	}
+	if t.Round < t.Rounds {
+		t.startRound()
+		return
+	}
+	t.State = TournamentFinished
+	log.Printf("Tournament %s finished", t.Name)
+	t.broadcast(fmt.Sprintf("Tournament [red]%s[white] is over!\n%s", t.Name, t.standingsString()))
+}
+
+// Standings sorted by score, then Buchholz, Sonneborn-Berger and rating. Caller must hold the lock
+func (t *Tournament) standings() []*TournamentPlayer {
+	standings := append([]*TournamentPlayer(nil), t.Players...)
+	sort.SliceStable(standings, func(i, j int) bool {
+		a, b := standings[i], standings[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Buchholz() != b.Buchholz() {
+			return a.Buchholz() > b.Buchholz()
+		}
+		if a.SonnebornBerger() != b.SonnebornBerger() {
+			return a.SonnebornBerger() > b.SonnebornBerger()
+		}
+		return a.Rating > b.Rating
+	})
+	return standings
+}
+
+// Caller must hold the lock
+func (t *Tournament) standingsString() string {
+	text := fmt.Sprintf("%-4s %-20s %5s %5s %5s\n", "#", "Name", "Score", "Buch", "SB")
+	for i, p := range t.standings() {
+		text += fmt.Sprintf("%-4d [green]%-20s[white] %5.1f %5.1f %5.2f\n", i+1, strings.Title(p.Name), p.Score, p.Buchholz(), p.SonnebornBerger())
+	}
+	return text
+}
+
+func (t *Tournament) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	text := fmt.Sprintf("Tournament [red]%s[white]: %s %d+%d, %s, round %d/%d\n", t.Name, t.Kind, t.Duration, t.Increment, t.State, t.Round, t.Rounds)
+	text += t.standingsString()
+	if t.State == TournamentRunning {
+		text += fmt.Sprintf("Round %d:\n", t.Round)
+		for _, pairing := range t.Pairings[t.Round-1] {
+			if pairing.Black == nil {
+				text += fmt.Sprintf("  %s: bye\n", strings.Title(pairing.White.Name))
+				continue
+			}
+			result := "playing in [red]" + pairing.Match.Name + "[white]"
+			if pairing.Forfeited {
+				result = "double forfeit"
+			} else if pairing.Done {
+				result = fmt.Sprintf("%s - %s", formatScore(pairing.Result), formatScore(1-pairing.Result))
+			}
+			text += fmt.Sprintf("  %s vs %s: %s\n", strings.Title(pairing.White.Name), strings.Title(pairing.Black.Name), result)
+		}
+	}
+	return text
+}
+
+// send queues the message until the lock is released. Caller must hold the lock
+func (t *Tournament) send(p *TournamentPlayer, text string) {
+	if p.Conn != nil {
+		t.pending = append(t.pending, notice{conn: p.Conn, text: text})
+	}
+}
+
+// unlock releases the lock, then sends the messages queued while holding it
+func (t *Tournament) unlock() {
+	pending := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	for _, n := range pending {
+		notify(n.conn, n.text)
+	}
+}
+
+// Caller must hold the lock
+func (t *Tournament) broadcast(text string) {
+	for _, p := range t.Players {
+		t.send(p, text)
+	}
+}
+
+// notify tells the client about its tournament, it might be in the lobby or still looking at the last game.
+// It doesn't wait, a client who stopped reading is disconnected
+func notify(sconn *ServerConn, text string) {
+	sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{text}})
+	sconn.Send(MessageGameChat{Message: fmt.Sprintf("[gray]%s[white]\n", text)})
+}
+
+func formatScore(score float64) string {
+	switch score {
+	case 0.5:
+		return "½"
+	default:
+		return fmt.Sprintf("%g", score)
+	}
+}
+
+type TournamentManager struct {
+	Server      *Server
+	mu          sync.Mutex
+	tournaments map[string]*Tournament
+}
+
+func NewTournamentManager(s *Server) *TournamentManager {
+	return &TournamentManager{
+		Server:      s,
+		tournaments: make(map[string]*Tournament),
+	}
+}
+
+func (tm *TournamentManager) Create(owner *ServerConn, name string, kind TournamentKind, rounds, duration, increment int) (*Tournament, error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if _, ok := tm.tournaments[name]; ok {
+		return nil, ErrTournamentExisted
+	}
+	t := &Tournament{
+		Name:      name,
+		Kind:      kind,
+		Owner:     owner.Key(),
+		Rounds:    rounds,
+		Duration:  duration,
+		Increment: increment,
+		Server:    tm.Server,
+	}
+	tm.tournaments[name] = t
+	return t, nil
+}
+
+func (tm *TournamentManager) Get(name string) (*Tournament, error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	t, ok := tm.tournaments[name]
+	if !ok {
+		return nil, ErrTournamentNotFound
+	}
+	return t, nil
+}
+
+func (tm *TournamentManager) List() []*Tournament {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	list := make([]*Tournament, 0, len(tm.tournaments))
+	for _, t := range tm.tournaments {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+const tournamentUsage = `Tournament commands:
+> [green]tournament create (name) (swiss|rr) (rounds) (duration) (increment)[white]
+> [green]tournament join (name)[white]
+> [green]tournament start (name)[white] : only the creator can start it
+> [green]tournament view (name)[white]`
+
+func (s *Server) HandleTournamentCommand(sconn *ServerConn, args []string) {
+	reply := func(text string) {
+		sconn.Send(MessageGameCommand{Command: CommandMessage, Argument: []string{text}})
+	}
+	if len(args) == 0 || args[0] == "" {
+		tournaments := s.Tournaments.List()
+		if len(tournaments) == 0 {
+			reply("No tournament yet :( Let's create one!\n" + tournamentUsage)
+			return
+		}
+		text := "Tournaments:\n"
+		for _, t := range tournaments {
+			t.mu.Lock()
+			text += fmt.Sprintf("[red]%s[white] %s %d+%d, %d players, %s\n", t.Name, t.Kind, t.Duration, t.Increment, len(t.Players), t.State)
+			t.mu.Unlock()
+		}
+		reply(text)
+		return
+	}
+	if len(args) < 2 {
+		reply(tournamentUsage)
+		return
+	}
+	if sconn.Name == "" {
+		sconn.Name = s.GuestName()
+	}
+	name := strings.ToLower(args[1])
+
+	switch args[0] {
+	case "create":
+		kind := TournamentSwiss
+		if len(args) > 2 && (args[2] == "rr" || args[2] == string(TournamentRoundRobin)) {
+			kind = TournamentRoundRobin
+		}
+		rounds, duration, increment := 5, 10, 0
+		if len(args) > 3 {
+			rounds, _ = strconv.Atoi(args[3])
+		}
+		if len(args) > 4 {
+			duration, _ = strconv.Atoi(args[4])
+		}
+		if len(args) > 5 {
+			increment, _ = strconv.Atoi(args[5])
+		}
+		if rounds <= 0 || duration <= 0 || increment < 0 {
+			reply(tournamentUsage)
+			return
+		}
+		if _, err := s.Tournaments.Create(sconn, name, kind, rounds, duration, increment); err != nil {
+			reply(fmt.Sprintf("Can't create tournament [red]%s[white]: %s", name, err))
+			return
+		}
+		reply(fmt.Sprintf("Created %s tournament [red]%s[white]. Players join with [green]tournament join %s[white], then start it with [green]tournament start %s[white]", kind, name, name, name))
+
+	case "join":
+		t, err := s.Tournaments.Get(name)
+		if err != nil {
+			reply(fmt.Sprintf("Can't join [red]%s[white]: %s", name, err))
+			return
+		}
+		rating := RatingDefault
+		if acc := s.Accounts.Get(sconn.Identity); acc != nil {
+			rating = acc.Rating(SpeedOf(time.Duration(t.Duration)*time.Minute, time.Duration(t.Increment)*time.Second)).Rating
+		}
+		if err := t.Join(sconn, rating); err != nil {
+			reply(fmt.Sprintf("Can't join [red]%s[white]: %s", name, err))
+		}
+
+	case "start":
+		t, err := s.Tournaments.Get(name)
+		if err == nil {
+			err = t.Start(sconn)
+		}
+		if err != nil {
+			reply(fmt.Sprintf("Can't start [red]%s[white]: %s", name, err))
+		}
+
+	case "view":
+		t, err := s.Tournaments.Get(name)
+		if err != nil {
+			reply(fmt.Sprintf("Can't view [red]%s[white]: %s", name, err))
+			return
+		}
+		reply(t.String())
+
+	default:
+		reply(tournamentUsage)
+	}
+}
@@ -1,6 +1,8 @@
 package pkg
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"github.com/gdamore/tcell/v2"
 	"github.com/notnil/chess"
 	"github.com/rivo/tview"
@@ -31,13 +33,31 @@ func squareToColor(sq chess.Square) tcell.Color {
 	}
 }
 
-func GameFromFEN(gamefen string) *chess.Game {
+func GameFromFEN(gamefen string) (*chess.Game, error) {
 	fen, err := chess.FEN(gamefen)
 	if err != nil {
+		return nil, err
+	}
+	return chess.NewGame(fen, chess.UseNotation(chess.UCINotation{})), nil
+}
+
+func GameFromMoves(moves []string) (*chess.Game, error) {
+	game := NewGame()
+	for _, move := range moves {
+		if err := game.MoveStr(move); err != nil {
+			return game, err
+		}
+	}
+	return game, nil
+}
+
+// NewToken returns a random hex string that can't be guessed
+func NewToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
 		log.Panic(err)
 	}
-	game := chess.NewGame(fen, chess.UseNotation(chess.UCINotation{}))
-	return game
+	return hex.EncodeToString(b)
 }
 
 func InitLog(dest, prefix string) {